@@ -0,0 +1,295 @@
+package flyreplay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(adminCache{})
+}
+
+// Admin API paths of the route caches
+const (
+	adminCachePath   = "/fly-replay/cache"
+	adminResolvePath = "/fly-replay/resolve"
+)
+
+// handlers tracks the provisioned FlyReplay handlers that have a route
+// cache, so the admin API can reach them
+var handlers struct {
+	sync.Mutex
+	active []*FlyReplay
+}
+
+// registerHandler makes f's route cache available to the admin API
+func registerHandler(f *FlyReplay) {
+	handlers.Lock()
+	defer handlers.Unlock()
+	handlers.active = append(handlers.active, f)
+}
+
+// unregisterHandler removes f from the admin API
+func unregisterHandler(f *FlyReplay) {
+	handlers.Lock()
+	defer handlers.Unlock()
+	handlers.active = slices.DeleteFunc(handlers.active, func(h *FlyReplay) bool { return h == f })
+}
+
+// activeHandlers returns the handlers with the given id, or all of them
+// when id is empty
+func activeHandlers(id string) []*FlyReplay {
+	handlers.Lock()
+	defer handlers.Unlock()
+
+	var matched []*FlyReplay
+	for _, f := range handlers.active {
+		if id == "" || f.ID == id {
+			matched = append(matched, f)
+		}
+	}
+	return matched
+}
+
+// adminCache is an admin API module to inspect and purge route caches.
+//
+//	GET    /fly-replay/cache[/<id>]    lists the unexpired entries
+//	DELETE /fly-replay/cache[/<id>]    removes entries matching ?key=, ?prefix=
+//	                                   and ?app=, or all of them without filters
+//	GET    /fly-replay/resolve?url=    tells where each handler would route url,
+//	                                   sent with the headers in ?header=
+//
+// Without an id, every fly_replay handler is affected.
+type adminCache struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminCache) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.fly_replay",
+		New: func() caddy.Module { return new(adminCache) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (a adminCache) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: adminCachePath, Handler: caddy.AdminHandlerFunc(a.handleCache)},
+		{Pattern: adminCachePath + "/", Handler: caddy.AdminHandlerFunc(a.handleCache)},
+		{Pattern: adminResolvePath, Handler: caddy.AdminHandlerFunc(a.handleResolve)},
+	}
+}
+
+// adminCacheList is one handler's route cache in a GET response
+type adminCacheList struct {
+	ID      string            `json:"id,omitempty"`
+	Entries []adminCacheEntry `json:"entries"`
+}
+
+// adminCacheEntry is a CacheEntry in a GET response
+type adminCacheEntry struct {
+	Key          string    `json:"key"`
+	Path         string    `json:"path"`
+	Target       string    `json:"target"`
+	Instance     string    `json:"instance,omitempty"`
+	Status       int       `json:"status,omitempty"` // status of the cached response, for negative entries
+	AllowBypass  bool      `json:"allow_bypass"`
+	Vary         []string  `json:"vary,omitempty"`
+	Variant      string    `json:"variant,omitempty"`
+	TTLRemaining int       `json:"ttl_remaining_secs"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// adminResolution is where one handler would route a URL
+type adminResolution struct {
+	ID           string `json:"id,omitempty"`
+	Key          string `json:"key"`    // host and path looked up in the cache
+	Source       string `json:"source"` // "cache", or "platform" when the platform decides
+	Reason       string `json:"reason"`
+	Target       string `json:"target,omitempty"`
+	Instance     string `json:"instance,omitempty"`
+	Status       int    `json:"status,omitempty"` // status answered from the negative cache
+	Pattern      string `json:"pattern,omitempty"`
+	AllowBypass  bool   `json:"allow_bypass,omitempty"`
+	TTLRemaining int    `json:"ttl_remaining_secs,omitempty"`
+}
+
+func (a adminCache) handleCache(w http.ResponseWriter, r *http.Request) error {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, adminCachePath), "/")
+	targets := activeHandlers(id)
+	if id != "" && len(targets) == 0 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no fly_replay handler with id %q and a route cache", id),
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		return a.list(w, targets)
+	case http.MethodDelete:
+		return a.purge(w, r, targets)
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method %s not allowed", r.Method),
+		}
+	}
+}
+
+// list writes the unexpired entries of each handler, sorted by key
+func (adminCache) list(w http.ResponseWriter, targets []*FlyReplay) error {
+	now := time.Now()
+	lists := make([]adminCacheList, 0, len(targets))
+	for _, f := range targets {
+		entries := f.cache.Entries()
+		slices.SortFunc(entries, func(a, b CacheEntry) int { return strings.Compare(a.key(), b.key()) })
+
+		list := adminCacheList{ID: f.ID, Entries: make([]adminCacheEntry, 0, len(entries))}
+		for _, e := range entries {
+			status := 0
+			if e.Response != nil {
+				status = e.Response.StatusCode
+			}
+			list.Entries = append(list.Entries, adminCacheEntry{
+				Key:          e.Pattern,
+				Path:         e.Path,
+				Target:       e.Target,
+				Instance:     e.Instance,
+				Status:       status,
+				AllowBypass:  e.AllowBypass,
+				Vary:         e.Vary,
+				Variant:      e.Variant,
+				TTLRemaining: int(e.ExpiresAt.Sub(now).Seconds()),
+				ExpiresAt:    e.ExpiresAt,
+			})
+		}
+		lists = append(lists, list)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(lists)
+}
+
+// purge removes the entries matching every filter in the query and writes
+// how many were removed
+func (adminCache) purge(w http.ResponseWriter, r *http.Request, targets []*FlyReplay) error {
+	query := r.URL.Query()
+	key, prefix, app := query.Get("key"), query.Get("prefix"), query.Get("app")
+
+	match := func(e *CacheEntry) bool {
+		return (key == "" || e.Pattern == key) &&
+			(prefix == "" || strings.HasPrefix(e.Pattern, prefix)) &&
+			(app == "" || e.Target == app)
+	}
+
+	removed := 0
+	for _, f := range targets {
+		n := f.cache.Remove(match)
+		if n == 0 {
+			continue
+		}
+		removed += n
+		f.logger.Info("route cache purged through admin API",
+			zap.String("key", key),
+			zap.String("prefix", prefix),
+			zap.String("app", app),
+			zap.Int("removed", n))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]int{"removed": removed})
+}
+
+func (adminCache) handleResolve(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method %s not allowed", r.Method),
+		}
+	}
+
+	raw := r.URL.Query().Get("url")
+	if raw == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("missing url parameter"),
+		}
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("invalid url %q", r.URL.Query().Get("url")),
+		}
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+
+	// The request as it would reach the handler, for entries that vary
+	req := &http.Request{Method: http.MethodGet, Host: u.Host, URL: u, Header: make(http.Header)}
+	for _, header := range r.URL.Query()["header"] {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid header %q, want Name: value", header),
+			}
+		}
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	targets := activeHandlers(r.URL.Query().Get("id"))
+	resolutions := make([]adminResolution, 0, len(targets))
+	for _, f := range targets {
+		resolutions = append(resolutions, f.resolve(u.Host+path, req))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resolutions)
+}
+
+// resolve tells where r, a request for fullPath, would go, mirroring the
+// cache check in ServeHTTP
+func (f *FlyReplay) resolve(fullPath string, r *http.Request) adminResolution {
+	res := adminResolution{ID: f.ID, Key: fullPath, Source: "platform"}
+
+	cached, found := f.cache.Get(fullPath, r)
+	if !found {
+		res.Reason = "no unexpired cache entry matches"
+		return res
+	}
+
+	res.Target = cached.Target
+	res.Instance = cached.Instance
+	res.Pattern = cached.Pattern
+	res.AllowBypass = cached.AllowBypass
+	res.TTLRemaining = int(time.Until(cached.ExpiresAt).Seconds())
+	if cached.Response != nil {
+		res.Source = "cache"
+		res.Status = cached.Response.StatusCode
+		res.Reason = fmt.Sprintf("negative cache entry %s", cached.Pattern)
+		return res
+	}
+	if _, ok := f.Apps[cached.Target]; !ok {
+		res.Reason = fmt.Sprintf("cached app %s is not configured", cached.Target)
+		return res
+	}
+
+	res.Source = "cache"
+	res.Reason = fmt.Sprintf("cache entry %s", cached.Pattern)
+	return res
+}
@@ -0,0 +1,171 @@
+package flyreplay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// defaultMemoryBufferSize is how much of a request body is kept in memory
+// before it spills to a temporary file
+const defaultMemoryBufferSize = 1 << 20
+
+// errBodyTooLarge is returned when a request body exceeds max_buffer_size
+var errBodyTooLarge = errors.New("request body exceeds max_buffer_size")
+
+// bodyReadError maps a failure reading the client's body to a status:
+// 413 when a request_body limit cut it short, 400 otherwise
+func bodyReadError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge, err)
+	}
+	return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("reading request body: %w", err))
+}
+
+// bufferedBody holds a request body so it can be sent to the platform and
+// replayed to apps. Small bodies stay in memory, larger ones spill to a
+// temporary file.
+type bufferedBody struct {
+	mem    []byte
+	file   *os.File
+	size   int64
+	stream io.ReadCloser // unbuffered body, which can only be sent once
+}
+
+// requestHasBody reports whether r carries a body at all; requests with
+// body-less methods like GET usually don't
+func requestHasBody(r *http.Request) bool {
+	return r.Body != nil && r.Body != http.NoBody
+}
+
+// streamBody wraps r's body without buffering it, for requests whose
+// target is known before anyone reads the body. It returns nil when r has
+// no body.
+func streamBody(r *http.Request) *bufferedBody {
+	if !requestHasBody(r) {
+		return nil
+	}
+	return &bufferedBody{stream: r.Body, size: r.ContentLength}
+}
+
+// bufferBody reads src until EOF. At most memLimit bytes are kept in memory;
+// the rest goes to a temporary file in dir. maxSize bounds the whole body,
+// zero meaning no limit. Errors are caddyhttp.HandlerErrors with the status
+// the client should see.
+func bufferBody(src io.Reader, memLimit, maxSize int64, dir string) (*bufferedBody, error) {
+	if maxSize > 0 {
+		// Read one byte past the limit to tell "exactly at" from "over"
+		src = io.LimitReader(src, maxSize+1)
+	}
+
+	b := &bufferedBody{}
+	var mem bytes.Buffer
+	n, err := io.Copy(&mem, io.LimitReader(src, memLimit+1))
+	if err != nil {
+		return nil, bodyReadError(err)
+	}
+	b.size = n
+
+	if n <= memLimit {
+		b.mem = mem.Bytes()
+		return b.checkSize(maxSize)
+	}
+
+	// Too large for memory; move what we have to disk and keep going
+	b.file, err = os.CreateTemp(dir, "fly-replay-body-*")
+	if err != nil {
+		return nil, caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("buffering request body: %w", err))
+	}
+	if _, err := b.file.Write(mem.Bytes()); err != nil {
+		b.Close()
+		return nil, caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("buffering request body: %w", err))
+	}
+
+	// Tell read failures apart from write failures
+	rest, err := io.Copy(b.file, readerOnly{src})
+	b.size += rest
+	if err != nil {
+		b.Close()
+		var readErr sourceError
+		if errors.As(err, &readErr) {
+			return nil, bodyReadError(readErr.err)
+		}
+		return nil, caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("buffering request body: %w", err))
+	}
+
+	return b.checkSize(maxSize)
+}
+
+// checkSize rejects a body that went past maxSize
+func (b *bufferedBody) checkSize(maxSize int64) (*bufferedBody, error) {
+	if maxSize > 0 && b.size > maxSize {
+		b.Close()
+		return nil, caddyhttp.Error(http.StatusRequestEntityTooLarge, errBodyTooLarge)
+	}
+	return b, nil
+}
+
+// restore sets a fresh reader over the buffered body on r. It is safe to
+// call on a nil body, which leaves r untouched.
+func (b *bufferedBody) restore(r *http.Request) {
+	if b == nil {
+		return
+	}
+	switch {
+	case b.stream != nil:
+		r.Body = b.stream
+	case b.size == 0:
+		r.Body = http.NoBody
+	case b.file != nil:
+		r.Body = io.NopCloser(io.NewSectionReader(b.file, 0, b.size))
+	default:
+		r.Body = io.NopCloser(bytes.NewReader(b.mem))
+	}
+	r.ContentLength = b.size
+}
+
+// replayable reports whether the body can be sent more than once
+func (b *bufferedBody) replayable() bool {
+	return b == nil || b.stream == nil
+}
+
+// bufferDir is where request bodies spill to: cache_dir when set, the
+// system's temporary directory otherwise
+func (f *FlyReplay) bufferDir() string {
+	if f.CacheDir != "" {
+		return f.CacheDir
+	}
+	return os.TempDir()
+}
+
+// Close removes the temporary file, if any
+func (b *bufferedBody) Close() error {
+	if b == nil || b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// sourceError marks an error that came from reading the client's body
+type sourceError struct{ err error }
+
+func (e sourceError) Error() string { return e.err.Error() }
+
+// readerOnly hides the source's WriterTo so io.Copy goes through Read,
+// where failures are tagged as sourceError
+type readerOnly struct{ r io.Reader }
+
+func (r readerOnly) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = sourceError{err}
+	}
+	return n, err
+}
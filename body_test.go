@@ -0,0 +1,178 @@
+package flyreplay
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// restoredBody reads b back the way a replay would
+func restoredBody(t *testing.T, b *bufferedBody) string {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/", nil)
+	b.restore(r)
+	if r.ContentLength != b.size {
+		t.Errorf("ContentLength = %d, want %d", r.ContentLength, b.size)
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// tempFiles returns the names of the files in dir
+func tempFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	return names
+}
+
+// statusOf returns the status a bufferBody error maps to
+func statusOf(t *testing.T, err error) int {
+	t.Helper()
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) {
+		t.Fatalf("error %v is not a caddyhttp.HandlerError", err)
+	}
+	return handlerErr.StatusCode
+}
+
+func TestBufferBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		memLimit int64
+		maxSize  int64
+		spills   bool
+	}{
+		{"empty", 0, 16, 0, false},
+		{"in memory", 10, 16, 0, false},
+		{"at memory limit", 16, 16, 0, false},
+		{"spills", 17, 16, 0, true},
+		{"no limit", 1 << 16, 16, 0, true},
+		{"at max size in memory", 10, 16, 10, false},
+		{"at max size on disk", 64, 16, 64, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			content := strings.Repeat("x", tt.size)
+
+			b, err := bufferBody(strings.NewReader(content), tt.memLimit, tt.maxSize, dir)
+			if err != nil {
+				t.Fatalf("bufferBody() error = %v", err)
+			}
+			if spilled := b.file != nil; spilled != tt.spills {
+				t.Errorf("spilled to disk = %v, want %v", spilled, tt.spills)
+			}
+			if !b.replayable() {
+				t.Errorf("buffered body isn't replayable")
+			}
+
+			// Every replay gets the whole body
+			for range 2 {
+				if got := restoredBody(t, b); got != content {
+					t.Errorf("restored %d bytes, want %d", len(got), len(content))
+				}
+			}
+
+			if err := b.Close(); err != nil {
+				t.Errorf("Close() error = %v", err)
+			}
+			if files := tempFiles(t, dir); len(files) > 0 {
+				t.Errorf("files left after Close: %v", files)
+			}
+		})
+	}
+}
+
+func TestBufferBodyEmptyRestoresNoBody(t *testing.T) {
+	b, err := bufferBody(strings.NewReader(""), 16, 0, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/", strings.NewReader("stale"))
+	b.restore(r)
+	if r.Body != http.NoBody {
+		t.Errorf("restored an empty body as %T, want http.NoBody", r.Body)
+	}
+}
+
+func TestBufferBodyTooLarge(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		memLimit int64
+		maxSize  int64
+	}{
+		{"in memory", 11, 16, 10},
+		{"on disk", 65, 16, 64},
+		{"far over", 1 << 16, 16, 64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			_, err := bufferBody(strings.NewReader(strings.Repeat("x", tt.size)), tt.memLimit, tt.maxSize, dir)
+			if !errors.Is(err, errBodyTooLarge) {
+				t.Fatalf("bufferBody() error = %v, want %v", err, errBodyTooLarge)
+			}
+			if status := statusOf(t, err); status != http.StatusRequestEntityTooLarge {
+				t.Errorf("status = %d, want %d", status, http.StatusRequestEntityTooLarge)
+			}
+			if files := tempFiles(t, dir); len(files) > 0 {
+				t.Errorf("files left after rejecting the body: %v", files)
+			}
+		})
+	}
+}
+
+func TestBufferBodyReadErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    func() io.Reader
+		status int
+	}{
+		{"client error in memory", func() io.Reader {
+			return iotest.TimeoutReader(strings.NewReader(strings.Repeat("x", 8)))
+		}, http.StatusBadRequest},
+		{"client error on disk", func() io.Reader {
+			return io.MultiReader(strings.NewReader(strings.Repeat("x", 32)), iotest.ErrReader(errors.New("reset")))
+		}, http.StatusBadRequest},
+		{"request_body limit", func() io.Reader {
+			return http.MaxBytesReader(httptest.NewRecorder(), io.NopCloser(strings.NewReader(strings.Repeat("x", 32))), 8)
+		}, http.StatusRequestEntityTooLarge},
+		{"request_body limit on disk", func() io.Reader {
+			return http.MaxBytesReader(httptest.NewRecorder(), io.NopCloser(strings.NewReader(strings.Repeat("x", 64))), 32)
+		}, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			_, err := bufferBody(tt.src(), 16, 0, dir)
+			if err == nil {
+				t.Fatal("bufferBody() succeeded on a failing reader")
+			}
+			if status := statusOf(t, err); status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+			if files := tempFiles(t, dir); len(files) > 0 {
+				t.Errorf("files left after a read error: %v", files)
+			}
+		})
+	}
+}
@@ -1,93 +1,411 @@
 package flyreplay
 
 import (
-	"strings"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync/atomic"
 	"time"
 )
 
-// Get retrieves a cache entry for the given full path
-func (c *PathCache) Get(fullPath string) (*CacheEntry, bool) {
+// Eviction policies for a cache that is full
+const (
+	EvictLRU = "lru" // least recently used
+	EvictLFU = "lfu" // least frequently used
+)
+
+// Reasons an entry left the cache, as reported to the eviction callback
+const (
+	evictedExpired    = "expired"
+	evictedMaxEntries = "max_entries"
+	evictedMaxMemory  = "max_memory"
+)
+
+// evictionSample is how many entries are compared to pick the one to
+// evict. Like Redis, the cache approximates LRU and LFU by sampling instead
+// of keeping every entry ordered, which would need the write lock on reads.
+const evictionSample = 16
+
+// entryOverhead estimates the memory an entry takes besides its strings:
+// the entry, its compiled pattern and its place in the store and index
+const entryOverhead = 512
+
+// Get retrieves a cache entry for the given full path. Entries that vary
+// on request headers or cookies only match when r has the same values;
+// r may be nil.
+func (c *PathCache) Get(fullPath string, r *http.Request) (*CacheEntry, bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	
+	now := time.Now()
+
 	// Check exact match first
-	if entry, ok := c.store[fullPath]; ok {
-		if time.Now().Before(entry.ExpiresAt) {
+	if entry, ok := c.store[fullPath]; ok && !indexed(entry) {
+		if now.Before(entry.ExpiresAt) {
+			c.touch(entry)
 			return entry, true
 		}
 		// Expired, will be cleaned up later
 	}
 	
-	// Check pattern matches
-	for pattern, entry := range c.store {
-		if matchesPattern(fullPath, pattern) && time.Now().Before(entry.ExpiresAt) {
-			return entry, true
+	// Check the pattern matches the index turns up, most specific first
+	var best *CacheEntry
+	for _, entry := range c.index.candidates(fullPath) {
+		if !now.Before(entry.ExpiresAt) || !entry.matcher.matches(fullPath) {
+			continue
+		}
+		if len(entry.Vary) > 0 && entry.Variant != variantKey(entry.Vary, r) {
+			continue
 		}
+		if best == nil || moreSpecific(entry, best) {
+			best = entry
+		}
+	}
+	if best != nil {
+		c.touch(best)
 	}
 	
-	return nil, false
+	return best, best != nil
 }
 
-// Set stores a new cache entry
-func (c *PathCache) Set(path, pattern, target string, ttl int, allowBypass bool) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// VaryFor returns the fields the most specific entry matching fullPath
+// varies on, whatever its variant and even if expired, or nil when no
+// matching entry varies
+func (c *PathCache) VaryFor(fullPath string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var best *CacheEntry
+	for _, entry := range c.index.candidates(fullPath) {
+		if len(entry.Vary) == 0 || !entry.matcher.matches(fullPath) {
+			continue
+		}
+		if best == nil || moreSpecific(entry, best) {
+			best = entry
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.Vary
+}
 
-	c.store[pattern] = &CacheEntry{
+// touch records a lookup served by entry, for eviction. Lookups only hold
+// the read lock, so the counters are updated atomically.
+func (c *PathCache) touch(entry *CacheEntry) {
+	atomic.StoreUint64(&entry.used, c.clock.Add(1))
+	atomic.AddUint64(&entry.hits, 1)
+}
+
+// moreSpecific reports whether entry a takes precedence over b. Precedence
+// between matching entries is:
+//
+//  1. an exact pattern, without wildcards
+//  2. the longest literal prefix before the first wildcard
+//  3. the fewest wildcards (*, ** and {name} alike)
+//  4. the most recently stored
+//
+// Store order is unique, so every lookup picks the same winner.
+func moreSpecific(a, b *CacheEntry) bool {
+	if aExact, bExact := a.matcher.wildcards == 0, b.matcher.wildcards == 0; aExact != bExact {
+		return aExact
+	}
+	if aPrefix, bPrefix := len(a.matcher.prefix), len(b.matcher.prefix); aPrefix != bPrefix {
+		return aPrefix > bPrefix
+	}
+	if a.matcher.wildcards != b.matcher.wildcards {
+		return a.matcher.wildcards < b.matcher.wildcards
+	}
+	return a.seq > b.seq
+}
+
+// Set stores a new cache entry. Patterns that don't compile are rejected.
+func (c *PathCache) Set(path, pattern, target, instance string, ttl int, allowBypass bool) error {
+	return c.SetVariant(path, pattern, nil, nil, target, instance, ttl, allowBypass)
+}
+
+// SetVariant stores a cache entry that only applies to requests with the
+// same values as r for the headers and cookies in vary, as returned by
+// parseVary. Each variant of a pattern is a separate entry; storing one
+// drops the pattern's entries that vary on other fields.
+func (c *PathCache) SetVariant(path, pattern string, vary []string, r *http.Request, target, instance string, ttl int, allowBypass bool) error {
+	return c.set(&CacheEntry{
 		Path:        path,
 		Target:      target,
+		Instance:    instance,
+		Pattern:     pattern,
+		AllowBypass: allowBypass,
+	}, vary, r, ttl)
+}
+
+// SetResponse stores a negative cache entry: resp is served to matching
+// requests instead of asking the platform. vary and r are as for
+// SetVariant.
+func (c *PathCache) SetResponse(path, pattern string, vary []string, r *http.Request, resp *CachedResponse, ttl int, allowBypass bool) error {
+	return c.set(&CacheEntry{
+		Path:        path,
 		Pattern:     pattern,
 		AllowBypass: allowBypass,
-		ExpiresAt:   time.Now().Add(time.Duration(ttl) * time.Second),
+		Response:    resp,
+	}, vary, r, ttl)
+}
+
+// set compiles the pattern of entry and stores it for ttl seconds
+func (c *PathCache) set(entry *CacheEntry, vary []string, r *http.Request, ttl int) error {
+	matcher, err := compilePattern(entry.Pattern)
+	if err != nil {
+		return fmt.Errorf("invalid cache pattern: %w", err)
 	}
+	entry.matcher = matcher
+	entry.ExpiresAt = time.Now().Add(time.Duration(ttl) * time.Second)
+	if len(vary) > 0 {
+		entry.Vary = vary
+		entry.Variant = variantKey(vary, r)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.put(entry)
+	return nil
 }
 
-// Invalidate removes a cache entry by pattern
+// key returns the store key of the entry: its pattern, followed by the
+// variant for entries that vary. Patterns never contain spaces.
+func (e *CacheEntry) key() string {
+	if e.Variant == "" {
+		return e.Pattern
+	}
+	return e.Pattern + " " + e.Variant
+}
+
+// put stores entry, replacing the one with the same pattern and variant.
+// The caller holds the write lock.
+func (c *PathCache) put(entry *CacheEntry) {
+	c.seq++
+	entry.seq = c.seq
+	entry.used = c.clock.Add(1)
+	entry.size = entrySize(entry)
+
+	// A pattern varies on one set of fields at a time, the latest
+	key := entry.key()
+	if old, exists := c.store[entry.Pattern]; exists && len(entry.Vary) > 0 {
+		c.delete(old.key())
+	}
+	for _, old := range c.variants[entry.Pattern] {
+		if !slices.Equal(old.Vary, entry.Vary) {
+			c.delete(old.key())
+		}
+	}
+	c.delete(key)
+
+	c.store[key] = entry
+	c.index.add(entry)
+	c.memory += entry.size
+	c.dirty.Store(true)
+	if entry.Variant != "" {
+		if c.variants[entry.Pattern] == nil {
+			c.variants[entry.Pattern] = make(map[string]*CacheEntry)
+		}
+		c.variants[entry.Pattern][entry.Variant] = entry
+	}
+
+	c.evict(entry)
+}
+
+// SetLimits bounds the cache to maxEntries entries and maxMemory estimated
+// bytes, 0 meaning no limit, evicting by policy (EvictLRU or EvictLFU) once
+// either is reached. onEvict, if not nil, is told about every entry that
+// is evicted or cleaned after expiring; it runs under the write lock and
+// must not call back into the cache.
+func (c *PathCache) SetLimits(maxEntries int, maxMemory int64, policy string, onEvict func(entry *CacheEntry, reason string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxEntries = maxEntries
+	c.maxMemory = maxMemory
+	c.eviction = policy
+	c.onEvict = onEvict
+	c.evict(nil)
+}
+
+// evict removes entries until the cache is within its limits again,
+// sparing keep, the entry just stored. The caller holds the write lock.
+func (c *PathCache) evict(keep *CacheEntry) {
+	for {
+		var reason string
+		switch {
+		case c.maxEntries > 0 && len(c.store) > c.maxEntries:
+			reason = evictedMaxEntries
+		case c.maxMemory > 0 && c.memory > c.maxMemory:
+			reason = evictedMaxMemory
+		default:
+			return
+		}
+
+		victim := c.victim(keep)
+		if victim == nil {
+			// Only keep is left, and it's too big on its own
+			return
+		}
+		c.delete(victim.key())
+		c.evicted(victim, reason)
+	}
+}
+
+// victim picks the entry to evict among a sample of the cache: any expired
+// one, otherwise the coldest by the eviction policy
+func (c *PathCache) victim(keep *CacheEntry) *CacheEntry {
+	now := time.Now()
+	var victim *CacheEntry
+	sampled := 0
+	// Map iteration starts at a random entry, which makes this a sample
+	for _, entry := range c.store {
+		if entry == keep {
+			continue
+		}
+		if !now.Before(entry.ExpiresAt) {
+			return entry
+		}
+		if victim == nil || c.colder(entry, victim) {
+			victim = entry
+		}
+		if sampled++; sampled == evictionSample {
+			break
+		}
+	}
+	return victim
+}
+
+// colder reports whether entry a should be evicted before b
+func (c *PathCache) colder(a, b *CacheEntry) bool {
+	aUsed, bUsed := atomic.LoadUint64(&a.used), atomic.LoadUint64(&b.used)
+	if c.eviction == EvictLFU {
+		if aHits, bHits := atomic.LoadUint64(&a.hits), atomic.LoadUint64(&b.hits); aHits != bHits {
+			return aHits < bHits
+		}
+	}
+	return aUsed < bUsed
+}
+
+// evicted reports an entry that left the cache on its own
+func (c *PathCache) evicted(entry *CacheEntry, reason string) {
+	if c.onEvict != nil {
+		c.onEvict(entry, reason)
+	}
+}
+
+// entrySize estimates the memory entry takes
+func entrySize(entry *CacheEntry) int64 {
+	size := entryOverhead + len(entry.Path) + 2*len(entry.Pattern) + len(entry.Target) + len(entry.Instance) + len(entry.Variant)
+	for _, field := range entry.Vary {
+		size += len(field)
+	}
+	if resp := entry.Response; resp != nil {
+		size += len(resp.Body)
+		for key, values := range resp.Header {
+			size += len(key)
+			for _, value := range values {
+				size += len(value)
+			}
+		}
+	}
+	return int64(size)
+}
+
+// delete removes the entry for pattern. The caller holds the write lock.
+func (c *PathCache) delete(key string) {
+	if entry, exists := c.store[key]; exists {
+		delete(c.store, key)
+		c.index.remove(entry)
+		c.memory -= entry.size
+		c.dirty.Store(true)
+		if entry.Variant != "" {
+			delete(c.variants[entry.Pattern], entry.Variant)
+			if len(c.variants[entry.Pattern]) == 0 {
+				delete(c.variants, entry.Pattern)
+			}
+		}
+	}
+}
+
+// Invalidate removes the cache entries for a pattern, every variant included
 func (c *PathCache) Invalidate(pattern string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	
-	delete(c.store, pattern)
+	c.delete(pattern)
+	for _, entry := range c.variants[pattern] {
+		c.delete(entry.key())
+	}
 }
 
-// Clean removes expired entries (can be called periodically)
-func (c *PathCache) Clean() {
+// Remove deletes the entries match returns true for and returns how many
+// were removed
+func (c *PathCache) Remove(match func(*CacheEntry) bool) int {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	
-	now := time.Now()
-	for pattern, entry := range c.store {
-		if now.After(entry.ExpiresAt) {
-			delete(c.store, pattern)
+
+	removed := 0
+	for key, entry := range c.store {
+		if match(entry) {
+			c.delete(key)
+			removed++
 		}
 	}
+	return removed
 }
 
-// matchesPattern checks if a path matches a pattern with wildcards
-func matchesPattern(path, pattern string) bool {
-	// Handle exact match
-	if path == pattern {
-		return true
+// Entries returns copies of the unexpired entries
+func (c *PathCache) Entries() []CacheEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now()
+	entries := make([]CacheEntry, 0, len(c.store))
+	for _, entry := range c.store {
+		if now.Before(entry.ExpiresAt) {
+			// Field by field, as lookups update the access counters concurrently
+			entries = append(entries, CacheEntry{
+				Path:        entry.Path,
+				Target:      entry.Target,
+				Instance:    entry.Instance,
+				Pattern:     entry.Pattern,
+				AllowBypass: entry.AllowBypass,
+				Response:    entry.Response,
+				Vary:        entry.Vary,
+				Variant:     entry.Variant,
+				ExpiresAt:   entry.ExpiresAt,
+				matcher:     entry.matcher,
+				seq:         entry.seq,
+			})
+		}
 	}
+	return entries
+}
+
+// Len returns the number of entries, including expired ones not yet cleaned
+func (c *PathCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.store)
+}
+
+// Clean removes expired entries and returns how many were removed. The
+// handler's janitor calls it every cleanup_interval.
+func (c *PathCache) Clean() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	
-	// Handle wildcard patterns
-	if strings.Contains(pattern, "*") {
-		// Convert pattern to a simple prefix match for patterns like /en-US/user123/*
-		prefix := strings.TrimSuffix(pattern, "*")
-		if strings.HasPrefix(path, prefix) {
-			return true
-		}
-		
-		// Handle more complex patterns if needed
-		// This is a simplified implementation
-		parts := strings.Split(pattern, "*")
-		if len(parts) == 2 {
-			// Pattern like /prefix/*/suffix
-			if strings.HasPrefix(path, parts[0]) && strings.HasSuffix(path, parts[1]) {
-				return true
-			}
+	now := time.Now()
+	removed := 0
+	for key, entry := range c.store {
+		if now.After(entry.ExpiresAt) {
+			c.delete(key)
+			c.evicted(entry, evictedExpired)
+			removed++
 		}
 	}
-	
-	return false
-}
\ No newline at end of file
+	return removed
+}
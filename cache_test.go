@@ -0,0 +1,302 @@
+package flyreplay
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// populateCache caches two patterns per tenant: a prefix wildcard and one
+// with a literal suffix
+func populateCache(tb testing.TB, size int) *PathCache {
+	tb.Helper()
+	cache := NewPathCache()
+	for i := range size {
+		app := fmt.Sprintf("user%d-app", i)
+		prefix := fmt.Sprintf("app.example.com/en-US/user%d/*", i)
+		suffix := fmt.Sprintf("app.example.com/files/*/user%d/avatar.png", i)
+		if err := cache.Set(prefix, prefix, app, "", 3600, false); err != nil {
+			tb.Fatal(err)
+		}
+		if err := cache.Set(suffix, suffix, app, "", 3600, false); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return cache
+}
+
+// benchmarkLookups are the lookups BenchmarkPathCacheGet runs against a
+// cache of size tenants. The last tenant is deepest in any insertion order.
+func benchmarkLookups(size int) []struct{ name, path string } {
+	return []struct{ name, path string }{
+		{"prefix", fmt.Sprintf("app.example.com/en-US/user%d/profile", size-1)},
+		{"suffix", fmt.Sprintf("app.example.com/files/large/user%d/avatar.png", size-1)},
+		{"miss", "app.example.com/en-US/nobody/profile"},
+	}
+}
+
+// BenchmarkPathCacheGet measures route cache lookups with 100 to 100,000
+// cached tenants. They should cost about the same at every size.
+func BenchmarkPathCacheGet(b *testing.B) {
+	for _, size := range []int{100, 1_000, 10_000, 100_000} {
+		cache := populateCache(b, size)
+		for _, lookup := range benchmarkLookups(size) {
+			b.Run(fmt.Sprintf("entries=%d/%s", size, lookup.name), func(b *testing.B) {
+				b.ReportAllocs()
+				for b.Loop() {
+					cache.Get(lookup.path, nil)
+				}
+			})
+		}
+	}
+}
+
+func TestPathCacheGetScales(t *testing.T) {
+	// A lookup only checks the entries the index returns, so that number
+	// must not grow with the number of tenants
+	candidates := func(size int) []int {
+		cache := populateCache(t, size)
+		var counts []int
+		for _, lookup := range benchmarkLookups(size) {
+			counts = append(counts, len(cache.index.candidates(lookup.path)))
+		}
+		if _, ok := cache.Get(benchmarkLookups(size)[0].path, nil); !ok {
+			t.Fatalf("no entry for the last tenant")
+		}
+		return counts
+	}
+
+	small, large := candidates(1_000), candidates(100_000)
+	if !slices.Equal(small, large) {
+		t.Errorf("candidates per lookup = %v for 1,000 tenants and %v for 100,000, want the same", small, large)
+	}
+	for i, n := range large {
+		if n > 2 {
+			t.Errorf("%s lookup checked %d entries", benchmarkLookups(1)[i].name, n)
+		}
+	}
+}
+
+func TestMoreSpecific(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string // a stored after b, so a wins ties
+		want bool
+	}{
+		{"exact beats wildcard", "example.com/en-US/user1", "example.com/en-US/user1*", true},
+		{"exact beats longer prefix", "example.com/a", "example.com/abc/*", true},
+		{"longer prefix", "example.com/en-US/user1/*", "example.com/en-US/*", true},
+		{"shorter prefix", "example.com/*/user1/profile", "example.com/en-US/*", false},
+		{"fewer wildcards", "example.com/en-US/*", "example.com/en-US/*/*", true},
+		{"params count as wildcards", "example.com/en-US/{user}/*", "example.com/en-US/*", false},
+		{"later store wins a tie", "example.com/en-US/*/a", "example.com/en-US/*/b", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := testEntry(t, tt.a), testEntry(t, tt.b)
+			a.seq, b.seq = 2, 1
+			if got := moreSpecific(a, b); got != tt.want {
+				t.Errorf("moreSpecific(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+			if got := moreSpecific(b, a); got == tt.want {
+				t.Errorf("moreSpecific(%q, %q) = %v, want %v", tt.b, tt.a, got, !tt.want)
+			}
+		})
+	}
+}
+
+func TestPathCacheGetPrecedence(t *testing.T) {
+	cache := NewPathCache()
+	for _, set := range []struct{ pattern, app string }{
+		{"example.com/en-US/user1/profile", "exact"},
+		{"example.com/en-US/user1/*", "prefix"},
+		{"example.com/en-US/*", "short"},
+		{"example.com/**/profile", "suffix"},
+	} {
+		if err := cache.Set(set.pattern, set.pattern, set.app, "", 60, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct{ path, want string }{
+		{"example.com/en-US/user1/profile", "exact"},
+		{"example.com/en-US/user1/settings", "prefix"},
+		{"example.com/en-US/user2/profile", "short"},
+		{"example.com/fr-FR/user2/profile", "suffix"},
+	}
+	for _, tt := range tests {
+		entry, ok := cache.Get(tt.path, nil)
+		if !ok {
+			t.Errorf("Get(%q) missed", tt.path)
+			continue
+		}
+		if entry.Target != tt.want {
+			t.Errorf("Get(%q) = %s, want %s", tt.path, entry.Target, tt.want)
+		}
+	}
+}
+
+// evictions records the entries a cache evicts, by pattern
+type evictions struct {
+	patterns []string
+	reasons  []string
+}
+
+func (e *evictions) record(entry *CacheEntry, reason string) {
+	e.patterns = append(e.patterns, entry.Pattern)
+	e.reasons = append(e.reasons, reason)
+}
+
+// setAll stores an entry for each pattern, in order
+func setAll(t *testing.T, cache *PathCache, patterns ...string) {
+	t.Helper()
+	for _, pattern := range patterns {
+		if err := cache.Set(pattern, pattern, "app", "", 60, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPathCacheEviction(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		gets   []string // lookups between storing a, b and c and storing d
+		want   string   // the entry d evicts
+	}{
+		{"lru oldest store", EvictLRU, nil, "example.com/a"},
+		{"lru lookup refreshes", EvictLRU, []string{"example.com/a"}, "example.com/b"},
+		{"lru lookup order", EvictLRU, []string{"example.com/b", "example.com/a"}, "example.com/c"},
+
+		// c was never looked up, however recently it was stored
+		{"lfu fewest hits", EvictLFU, []string{"example.com/a", "example.com/a", "example.com/b"}, "example.com/c"},
+		{"lfu more hits", EvictLFU, []string{"example.com/b", "example.com/c", "example.com/b"}, "example.com/a"},
+		{"lfu ties go to lru", EvictLFU, []string{"example.com/c", "example.com/b"}, "example.com/a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var evicted evictions
+			cache := NewPathCache()
+			cache.SetLimits(3, 0, tt.policy, evicted.record)
+			setAll(t, cache, "example.com/a", "example.com/b", "example.com/c")
+			for _, path := range tt.gets {
+				if _, ok := cache.Get(path, nil); !ok {
+					t.Fatalf("Get(%q) missed", path)
+				}
+			}
+			setAll(t, cache, "example.com/d")
+
+			if !slices.Equal(evicted.patterns, []string{tt.want}) {
+				t.Errorf("evicted %q, want %q", evicted.patterns, tt.want)
+			}
+			if !slices.Equal(evicted.reasons, []string{evictedMaxEntries}) {
+				t.Errorf("reasons = %q, want %q", evicted.reasons, evictedMaxEntries)
+			}
+			if cache.Len() != 3 {
+				t.Errorf("Len() = %d, want 3", cache.Len())
+			}
+			if _, ok := cache.Get("example.com/d", nil); !ok {
+				t.Errorf("the entry just stored was evicted")
+			}
+		})
+	}
+}
+
+func TestPathCacheEvictsExpiredFirst(t *testing.T) {
+	var evicted evictions
+	cache := NewPathCache()
+	cache.SetLimits(2, 0, EvictLRU, evicted.record)
+	setAll(t, cache, "example.com/a")
+	if err := cache.Set("example.com/b", "example.com/b", "app", "", 0, false); err != nil {
+		t.Fatal(err)
+	}
+	cache.Get("example.com/a", nil)
+	setAll(t, cache, "example.com/c")
+
+	if !slices.Equal(evicted.patterns, []string{"example.com/b"}) {
+		t.Errorf("evicted %q, want the expired entry", evicted.patterns)
+	}
+}
+
+func TestPathCacheMaxMemory(t *testing.T) {
+	var evicted evictions
+	cache := NewPathCache()
+	setAll(t, cache, "example.com/a")
+	size := cache.memory
+
+	// Room for two entries of the same size
+	cache.SetLimits(0, 2*size, EvictLRU, evicted.record)
+	setAll(t, cache, "example.com/b", "example.com/c")
+	if !slices.Equal(evicted.patterns, []string{"example.com/a"}) || !slices.Equal(evicted.reasons, []string{evictedMaxMemory}) {
+		t.Errorf("evicted %q for %q, want example.com/a for %s", evicted.patterns, evicted.reasons, evictedMaxMemory)
+	}
+	if cache.memory != 2*size {
+		t.Errorf("memory = %d, want %d", cache.memory, 2*size)
+	}
+
+	// Lowering the limit evicts right away
+	cache.SetLimits(0, size, EvictLRU, evicted.record)
+	if cache.Len() != 1 || cache.memory != size {
+		t.Errorf("Len() = %d, memory = %d after lowering max_memory, want 1 and %d", cache.Len(), cache.memory, size)
+	}
+}
+
+func TestPathCacheMemoryAccounting(t *testing.T) {
+	cache := NewPathCache()
+	setAll(t, cache, "example.com/a", "example.com/b/*", "example.com/c")
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Tenant", "t1")
+	if err := cache.SetVariant("example.com/v", "example.com/v", []string{"X-Tenant"}, r, "app", "", 60, false); err != nil {
+		t.Fatal(err)
+	}
+	resp := &CachedResponse{StatusCode: 404, Header: http.Header{"X-Reason": {"unknown"}}, Body: []byte("no such tenant")}
+	if err := cache.SetResponse("example.com/n", "example.com/n", nil, nil, resp, 60, false); err != nil {
+		t.Fatal(err)
+	}
+	total := cache.memory
+
+	// Replacing an entry doesn't count it twice
+	setAll(t, cache, "example.com/a")
+	if cache.memory != total {
+		t.Errorf("memory = %d after replacing an entry, want %d", cache.memory, total)
+	}
+
+	cache.Invalidate("example.com/a")
+	cache.Remove(func(entry *CacheEntry) bool { return entry.Pattern != "example.com/b/*" })
+	if err := cache.Set("example.com/b/*", "example.com/b/*", "app", "", 0, false); err != nil {
+		t.Fatal(err)
+	}
+	cache.Clean()
+
+	if cache.Len() != 0 || cache.memory != 0 {
+		t.Errorf("Len() = %d, memory = %d after deleting every entry, want 0 and 0", cache.Len(), cache.memory)
+	}
+}
+
+func TestPathCacheCleanReportsExpired(t *testing.T) {
+	var evicted evictions
+	cache := NewPathCache()
+	cache.SetLimits(0, 0, EvictLRU, evicted.record)
+	setAll(t, cache, "example.com/live")
+	for _, pattern := range []string{"example.com/a", "example.com/b/*"} {
+		if err := cache.Set(pattern, pattern, "app", "", 0, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if removed := cache.Clean(); removed != 2 {
+		t.Errorf("Clean() = %d, want 2", removed)
+	}
+	slices.Sort(evicted.patterns)
+	if !slices.Equal(evicted.patterns, []string{"example.com/a", "example.com/b/*"}) {
+		t.Errorf("evicted %q, want the expired entries", evicted.patterns)
+	}
+	if !slices.Equal(evicted.reasons, []string{evictedExpired, evictedExpired}) {
+		t.Errorf("reasons = %q, want %s", evicted.reasons, evictedExpired)
+	}
+	if cache.Len() != 1 {
+		t.Errorf("Len() = %d, want 1", cache.Len())
+	}
+}
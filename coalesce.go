@@ -0,0 +1,93 @@
+package flyreplay
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultCoalesceTimeout is how long a request waits for another one's
+// platform decision when coalesce_timeout isn't set
+const defaultCoalesceTimeout = 5 * time.Second
+
+// flightGroup collapses concurrent cache misses for the same host and
+// path (and variant, see flightKey): the first request asks the platform,
+// the others wait for it and then look the path up in the cache again,
+// where the platform's decision is stored if it was cacheable and applies
+// to their variant.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is one platform call others may wait for
+type flight struct {
+	group *flightGroup
+	key   string
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// join returns the flight in progress for key, or starts one. leader is
+// true for the request that started it, which must land it.
+func (g *flightGroup) join(key string) (fl *flight, leader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if fl, ok := g.flights[key]; ok {
+		return fl, false
+	}
+	fl = &flight{group: g, key: key, done: make(chan struct{})}
+	g.flights[key] = fl
+	return fl, true
+}
+
+// land releases the requests waiting for fl. It can be called more than
+// once; later calls do nothing.
+func (fl *flight) land() {
+	fl.once.Do(func() {
+		fl.group.mu.Lock()
+		delete(fl.group.flights, fl.key)
+		fl.group.mu.Unlock()
+		close(fl.done)
+	})
+}
+
+// flightKey returns the key concurrent misses for r are collapsed on: the
+// host and path, and the request's variant when the cache knows which
+// fields the path varies on. Those are only known from an entry for another
+// variant of the path, since the platform names them in its answer; on a
+// cold path, requests of every variant wait for the first one, and those
+// of another variant then ask the platform themselves.
+func (f *FlyReplay) flightKey(fullPath string, r *http.Request) string {
+	if vary := f.cache.VaryFor(fullPath); len(vary) > 0 {
+		return fullPath + " " + variantKey(vary, r)
+	}
+	return fullPath
+}
+
+// awaitFlight waits for the leader of fl to get the platform's decision,
+// up to coalesce_timeout. It reports whether the decision arrived.
+func (f *FlyReplay) awaitFlight(r *http.Request, fl *flight) bool {
+	timer := time.NewTimer(time.Duration(f.CoalesceTimeout))
+	defer timer.Stop()
+
+	select {
+	case <-fl.done:
+		return true
+	case <-timer.C:
+		f.metrics.coalescedRequests.WithLabelValues(f.metricsHost(r), "timeout").Inc()
+		f.logger.Debug("gave up waiting for concurrent platform decision",
+			zap.String("key", fl.key),
+			zap.Duration("timeout", time.Duration(f.CoalesceTimeout)))
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
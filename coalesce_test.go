@@ -0,0 +1,202 @@
+package flyreplay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// coalescing returns a handler with a cache and one app, app, that answers
+// every request, coalescing misses for up to timeout
+func coalescing(t *testing.T, timeout time.Duration) *FlyReplay {
+	addr := testApp(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("app"))
+	})
+	return provision(t, &FlyReplay{
+		EnableCache:     true,
+		CoalesceTimeout: caddy.Duration(timeout),
+		Apps: map[string]AppConfig{
+			"app": {Instances: map[string]InstanceConfig{"i1": {Address: addr}}},
+		},
+	})
+}
+
+// coalesced returns how many requests waited for another one's platform
+// call with the given result
+func coalesced(f *FlyReplay, result string) int {
+	metrics := make(chan prometheus.Metric, 16)
+	f.metrics.coalescedRequests.Collect(metrics)
+	close(metrics)
+
+	var n int
+	for metric := range metrics {
+		var m dto.Metric
+		metric.Write(&m)
+		for _, label := range m.GetLabel() {
+			if label.GetName() == "result" && label.GetValue() == result {
+				n += int(m.GetCounter().GetValue())
+			}
+		}
+	}
+	return n
+}
+
+// tenantRequest is a request for the same path of every tenant
+func tenantRequest(tenant string) *http.Request {
+	r := httptest.NewRequest("GET", "http://example.com/tenant/a", nil)
+	r.Header.Set("X-Tenant", tenant)
+	return r
+}
+
+func TestServeHTTPCoalescesMisses(t *testing.T) {
+	f := coalescing(t, 5*time.Second)
+	started, release := make(chan struct{}, 10), make(chan struct{})
+	platform := &testPlatform{serve: func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Header().Set("fly-replay", "app=app")
+		w.Header().Set("fly-replay-cache", "/tenant/*")
+		w.WriteHeader(http.StatusOK)
+	}}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			if w := serve(t, f, platform, tenantRequest("t1")); w.Body.String() != "app" {
+				t.Errorf("got %d %q, want the app's response", w.Code, w.Body.String())
+			}
+		})
+	}
+	<-started
+	time.Sleep(50 * time.Millisecond) // for the others to join the flight
+	close(release)
+	wg.Wait()
+
+	if got := platform.calls.Load(); got != 1 {
+		t.Errorf("platform called %d times for 10 concurrent misses, want 1", got)
+	}
+	if coalesced(f, "hit") == 0 {
+		t.Errorf("no request waited for the platform's decision")
+	}
+}
+
+func TestServeHTTPCoalesceReleasesPassThrough(t *testing.T) {
+	f := coalescing(t, 5*time.Second)
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	platform := &testPlatform{serve: func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		if r.Header.Get("X-Tenant") != "leader" {
+			w.Write([]byte("platform"))
+			return
+		}
+		// Stream a response of the platform's own, and keep it open
+		w.WriteHeader(http.StatusOK)
+		http.NewResponseController(w).Flush()
+		<-release
+	}}
+
+	var wg sync.WaitGroup
+	wg.Go(func() { serve(t, f, platform, tenantRequest("leader")) })
+	<-started
+
+	// The leader's response decides nothing, so this one goes ahead while
+	// it still streams
+	if w := serve(t, f, platform, tenantRequest("follower")); w.Body.String() != "platform" {
+		t.Errorf("got %d %q, want the platform's response", w.Code, w.Body.String())
+	}
+	close(release)
+	wg.Wait()
+
+	if got := platform.calls.Load(); got != 2 {
+		t.Errorf("platform called %d times, want 2", got)
+	}
+	if got := coalesced(f, "timeout"); got != 0 {
+		t.Errorf("request waited for a streaming response until it timed out")
+	}
+}
+
+func TestServeHTTPCoalesceTimeout(t *testing.T) {
+	f := coalescing(t, 50*time.Millisecond)
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	platform := &testPlatform{serve: func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		if r.Header.Get("X-Tenant") == "leader" {
+			<-release
+		}
+		w.Header().Set("fly-replay", "app=app")
+		w.WriteHeader(http.StatusOK)
+	}}
+
+	var wg sync.WaitGroup
+	wg.Go(func() { serve(t, f, platform, tenantRequest("leader")) })
+	<-started
+
+	// Gives up on the held leader and asks the platform itself
+	if w := serve(t, f, platform, tenantRequest("follower")); w.Body.String() != "app" {
+		t.Errorf("got %d %q, want the app's response", w.Code, w.Body.String())
+	}
+	close(release)
+	wg.Wait()
+
+	if got := platform.calls.Load(); got != 2 {
+		t.Errorf("platform called %d times, want 2", got)
+	}
+	if got := coalesced(f, "timeout"); got != 1 {
+		t.Errorf("timeouts = %d, want 1", got)
+	}
+}
+
+func TestServeHTTPCoalesceVariants(t *testing.T) {
+	f := coalescing(t, 5*time.Second)
+	started, release := make(chan struct{}, 10), make(chan struct{})
+	platform := &testPlatform{serve: func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		if r.Header.Get("X-Tenant") == "t1" || r.Header.Get("X-Tenant") == "t3" {
+			<-release
+		}
+		w.Header().Set("fly-replay", "app=app")
+		w.Header().Set("fly-replay-cache", "/tenant/*")
+		w.Header().Set("fly-replay-cache-vary", "X-Tenant")
+		w.WriteHeader(http.StatusOK)
+	}}
+
+	// On a cold path the fields the platform decides on aren't known, so
+	// t2 waits for t1, finds no entry for its own variant and asks the
+	// platform itself
+	var wg sync.WaitGroup
+	wg.Go(func() { serve(t, f, platform, tenantRequest("t1")) })
+	<-started
+	wg.Go(func() { serve(t, f, platform, tenantRequest("t2")) })
+	time.Sleep(50 * time.Millisecond) // for t2 to join the flight
+	close(release)
+	wg.Wait()
+	<-started // t2's own call
+	if got := platform.calls.Load(); got != 2 {
+		t.Errorf("platform called %d times for two variants of a cold path, want 2", got)
+	}
+	if got := coalesced(f, "miss"); got != 1 {
+		t.Errorf("requests that waited and missed = %d, want 1", got)
+	}
+
+	// Once they are, t4 doesn't wait for t3
+	release = make(chan struct{})
+	wg.Go(func() { serve(t, f, platform, tenantRequest("t3")) })
+	<-started
+	if w := serve(t, f, platform, tenantRequest("t4")); w.Body.String() != "app" {
+		t.Errorf("got %d %q, want the app's response", w.Code, w.Body.String())
+	}
+	close(release)
+	wg.Wait()
+	if got := platform.calls.Load(); got != 4 {
+		t.Errorf("platform called %d times, want 4", got)
+	}
+	if got := coalesced(f, "miss") + coalesced(f, "hit") + coalesced(f, "timeout"); got != 1 {
+		t.Errorf("t4 waited for the platform's decision for t3")
+	}
+}
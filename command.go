@@ -0,0 +1,211 @@
+package flyreplay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "fly-replay",
+		Usage: "cache ls|purge | resolve <url>",
+		Short: "Inspects the route caches of a running fly_replay handler",
+		Long: `
+Talks to the admin API of a running Caddy instance to list and purge the
+route caches of its fly_replay handlers, and to tell where a URL would be
+routed.
+
+Use --id to address the handler with that id only; without it, every
+fly_replay handler with enable_cache is affected.
+
+The admin API address is taken from --address, or from the config given
+with --config and --adapter, like for 'caddy reload'.`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cache := &cobra.Command{
+				Use:   "cache",
+				Short: "Lists or purges route cache entries",
+			}
+
+			ls := &cobra.Command{
+				Use:   "ls [--id <id>]",
+				Short: "Lists the unexpired route cache entries",
+				Args:  cobra.NoArgs,
+				RunE:  caddycmd.WrapCommandFuncForCobra(cmdCacheList),
+			}
+			addAdminFlags(ls)
+
+			purge := &cobra.Command{
+				Use:   "purge [--id <id>] [--key <key>] [--prefix <prefix>] [--app <app>] [--all]",
+				Short: "Removes route cache entries",
+				Long: `
+Removes the route cache entries matching every given filter. Use --all to
+flush the cache without filters.`,
+				Args: cobra.NoArgs,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdCachePurge),
+			}
+			addAdminFlags(purge)
+			purge.Flags().String("key", "", "Remove the entry with exactly this key")
+			purge.Flags().String("prefix", "", "Remove entries whose key starts with this prefix")
+			purge.Flags().String("app", "", "Remove entries that route to this app")
+			purge.Flags().Bool("all", false, "Remove all entries")
+
+			cache.AddCommand(ls, purge)
+
+			resolve := &cobra.Command{
+				Use:   "resolve [--id <id>] [--header <name: value>...] <url>",
+				Short: "Tells which app a URL would be routed to, and why",
+				Args:  cobra.ExactArgs(1),
+				RunE:  caddycmd.WrapCommandFuncForCobra(cmdResolve),
+			}
+			addAdminFlags(resolve)
+			resolve.Flags().StringArrayP("header", "H", nil, "Request header to resolve with, for cache entries that vary on it")
+
+			cmd.AddCommand(cache, resolve)
+		},
+	})
+}
+
+// addAdminFlags adds the flags that locate the admin API and the handler
+func addAdminFlags(cmd *cobra.Command) {
+	cmd.Flags().String("address", "", "The address of the admin API")
+	cmd.Flags().StringP("config", "c", "", "Configuration file to read the admin address from")
+	cmd.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+	cmd.Flags().String("id", "", "Only the fly_replay handler with this id")
+}
+
+func cmdCacheList(fl caddycmd.Flags) (int, error) {
+	uri := adminCachePath
+	if id := fl.String("id"); id != "" {
+		uri += "/" + url.PathEscape(id)
+	}
+
+	var lists []adminCacheList
+	if err := adminRequest(fl, http.MethodGet, uri, &lists); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HANDLER\tKEY\tVARY\tTARGET\tINSTANCE\tTTL\tBYPASS")
+	for _, list := range lists {
+		for _, e := range list.Entries {
+			target := e.Target
+			if e.Status != 0 {
+				target = fmt.Sprintf("(%d response)", e.Status)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%ds\t%t\n",
+				orDash(list.ID), e.Key, orDash(strings.Join(e.Vary, ",")), target, orDash(e.Instance), e.TTLRemaining, e.AllowBypass)
+		}
+	}
+	return caddy.ExitCodeSuccess, tw.Flush()
+}
+
+func cmdCachePurge(fl caddycmd.Flags) (int, error) {
+	query := url.Values{}
+	for _, filter := range []string{"key", "prefix", "app"} {
+		if value := fl.String(filter); value != "" {
+			query.Set(filter, value)
+		}
+	}
+	if len(query) == 0 && !fl.Bool("all") {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("give --key, --prefix or --app, or --all to flush the cache")
+	}
+
+	uri := adminCachePath
+	if id := fl.String("id"); id != "" {
+		uri += "/" + url.PathEscape(id)
+	}
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+
+	var result struct {
+		Removed int `json:"removed"`
+	}
+	if err := adminRequest(fl, http.MethodDelete, uri, &result); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	fmt.Printf("Removed %d entries\n", result.Removed)
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdResolve(fl caddycmd.Flags) (int, error) {
+	query := url.Values{"url": {fl.Arg(0)}}
+	if id := fl.String("id"); id != "" {
+		query.Set("id", id)
+	}
+	headers, err := fl.GetStringArray("header")
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	for _, header := range headers {
+		query.Add("header", header)
+	}
+
+	var resolutions []adminResolution
+	if err := adminRequest(fl, http.MethodGet, adminResolvePath+"?"+query.Encode(), &resolutions); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if len(resolutions) == 0 {
+		fmt.Println("No fly_replay handler with a route cache; every request asks the platform")
+		return caddy.ExitCodeSuccess, nil
+	}
+
+	for _, res := range resolutions {
+		prefix := ""
+		if res.ID != "" {
+			prefix = res.ID + ": "
+		}
+		switch res.Source {
+		case "cache":
+			target := res.Target
+			if res.Instance != "" {
+				target += " (instance " + res.Instance + ")"
+			}
+			if res.Status != 0 {
+				target = fmt.Sprintf("%d response", res.Status)
+			}
+			fmt.Printf("%s%s -> %s from %s, expires in %ds\n", prefix, res.Key, target, res.Reason, res.TTLRemaining)
+		default:
+			fmt.Printf("%s%s -> needs platform: %s\n", prefix, res.Key, res.Reason)
+		}
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// adminRequest sends a request to the admin API and decodes its JSON
+// response into v
+func adminRequest(fl caddycmd.Flags, method, uri string, v any) error {
+	adminAddr, err := caddycmd.DetermineAdminAPIAddress(fl.String("address"), nil, fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return fmt.Errorf("couldn't determine admin API address: %w", err)
+	}
+
+	resp, err := caddycmd.AdminAPIRequest(adminAddr, method, uri, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decoding admin API response: %w", err)
+	}
+	return nil
+}
+
+// orDash returns s, or "-" when s is empty, for table cells
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
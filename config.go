@@ -1,44 +1,162 @@
 package flyreplay
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
 )
 
 // FlyReplay is the main configuration structure for the plugin
 type FlyReplay struct {
+	ID          string               `json:"id,omitempty"` // names this handler's route cache on the admin API
 	Apps        map[string]AppConfig `json:"apps,omitempty"`
 	CacheDir    string               `json:"cache_dir,omitempty"`
 	CacheTTL    int                  `json:"cache_ttl,omitempty"`  // default TTL in seconds
 	EnableCache bool                 `json:"enable_cache,omitempty"`
-	Debug       bool                 `json:"debug,omitempty"`
+	Debug       bool                 `json:"debug,omitempty"`       // log every routing decision
+	MaxReplays  int                  `json:"max_replays,omitempty"` // replays followed per request, including the platform's; 0 means the default of 5
+
+	// Route cache bounds; the coldest entries are evicted to stay within them
+	MaxEntries      int            `json:"max_entries,omitempty"`      // 0 for no limit
+	MaxMemory       int64          `json:"max_memory,omitempty"`       // estimated bytes, 0 for no limit
+	Eviction        string         `json:"eviction,omitempty"`         // lru (default) or lfu
+	CleanupInterval caddy.Duration `json:"cleanup_interval,omitempty"` // how often expired entries are swept
+
+	// Cache platform responses marked with fly-replay-cache, such as 404s
+	// for unknown tenants, and serve them without asking the platform
+	NegativeCache        bool  `json:"negative_cache,omitempty"`
+	NegativeCacheMaxBody int64 `json:"negative_cache_max_body,omitempty"` // larger responses aren't cached
+
+	// How long concurrent cache misses for the same path wait for the
+	// first one's platform decision; negative disables coalescing
+	CoalesceTimeout caddy.Duration `json:"coalesce_timeout,omitempty"`
+
+	// Request body buffering for replays
+	MaxBufferSize    int64 `json:"max_buffer_size,omitempty"`    // largest request body accepted, 0 for no limit
+	MemoryBufferSize int64 `json:"memory_buffer_size,omitempty"` // bodies larger than this spill to a temporary file
+
+	// Consult the platform with headers only and stream bodies to the app,
+	// so request bodies are never buffered
+	AskPlatformHeadersOnly bool `json:"ask_platform_headers_only,omitempty"`
+
+	// Label cache metrics with the request host, like Caddy's per_host
+	// metrics option. Clients choose the host, so only enable this when the
+	// hosts reaching the handler are a known few.
+	MetricsPerHost bool `json:"metrics_per_host,omitempty"`
+
+	// Region emulation
+	Region        string                    `json:"region,omitempty"`         // region this proxy runs in, sent as Fly-Region
+	RegionLatency map[string]caddy.Duration `json:"region_latency,omitempty"` // artificial latency added when forwarding to a region
 	
-	cache *PathCache
+	cache     *PathCache
+	cacheFile string // snapshot location inside CacheDir, empty when not persisting
+	metrics   *replayMetrics
+	logger    *zap.Logger
+	janitor   chan struct{} // closed to stop the cache janitor
+	flights   *flightGroup  // platform calls in progress, nil when not coalescing
 }
 
 // AppConfig holds the configuration for each app
 type AppConfig struct {
-	Domain string `json:"domain"`  // where to forward (e.g., localhost:9001)
+	Domain string `json:"domain,omitempty"`  // where to forward (e.g., localhost:9001)
+
+	// Optional reverse_proxy handler used instead of Domain, for load
+	// balancing, health checks, retries and header manipulation
+	ReverseProxyRaw json.RawMessage `json:"reverse_proxy,omitempty" caddy:"namespace=http.handlers inline_key=handler"`
+
+	// Connection pool tuning for the app's shared transport
+	KeepAlive             caddy.Duration `json:"keepalive,omitempty"` // TCP keepalive interval, negative disables keepalive
+	MaxIdleConns          int            `json:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost   int            `json:"max_idle_conns_per_host,omitempty"`
+	IdleConnTimeout       caddy.Duration `json:"idle_conn_timeout,omitempty"`
+	DialTimeout           caddy.Duration `json:"dial_timeout,omitempty"`
+	ResponseHeaderTimeout caddy.Duration `json:"response_header_timeout,omitempty"`
+
+	// Named instances (machines) of the app, as an alternative to Domain;
+	// replays can target them with instance= and prefer_instance=
+	Instances map[string]InstanceConfig `json:"instances,omitempty"`
+
+	// Region of instances that don't name one; defaults to FlyReplay.Region
+	Region string `json:"region,omitempty"`
+
+	transport    *http.Transport
+	instances    []*appInstance // provisioned from Domain or Instances
+	rotation     *atomic.Uint64 // spreads requests across instances
+	reverseProxy *reverseproxy.Handler
+}
+
+// InstanceConfig describes one instance of an app
+type InstanceConfig struct {
+	Address string `json:"address"`          // where to forward (e.g., localhost:9001)
+	Region  string `json:"region,omitempty"` // region the instance runs in
+}
+
+// appInstance is a provisioned instance with its own reverse proxy
+type appInstance struct {
+	id     string // empty for an app configured with a plain domain
+	region string
+	target *url.URL
+	proxy  *httputil.ReverseProxy
 }
 
 // PathCache manages the path-based caching
 type PathCache struct {
-	mu    sync.RWMutex
-	store map[string]*CacheEntry  // full path -> cache entry
+	mu       sync.RWMutex
+	store    map[string]*CacheEntry            // pattern, and variant if any -> cache entry
+	index    *cacheIndex                       // wildcard patterns and variants, for lookups
+	variants map[string]map[string]*CacheEntry // pattern -> variant -> cache entry
+	seq      uint64                            // last store order handed out
+	saveMu   sync.Mutex                        // serializes snapshot writes
+	dirty    atomic.Bool                       // changed since the last snapshot
+
+	// Bounds and eviction
+	maxEntries int
+	maxMemory  int64
+	eviction   string
+	memory     int64                                  // estimated size of all entries
+	clock      atomic.Uint64                          // last access time handed out
+	onEvict    func(entry *CacheEntry, reason string) // called under the write lock
 }
 
 // CacheEntry represents a cached routing decision
 type CacheEntry struct {
-	Path        string    // full path including domain
-	Target      string    // app name from fly-replay header
-	Pattern     string    // pattern from fly-replay-cache header
-	AllowBypass bool      // whether the cache entry can be bypassed
+	Path        string          // full path including domain
+	Target      string          // app name from fly-replay header, empty for negative entries
+	Instance    string          // instance from fly-replay header, if pinned
+	Pattern     string          // pattern from fly-replay-cache header
+	AllowBypass bool            // whether the cache entry can be bypassed
+	Response    *CachedResponse // platform response served instead of a replay, for negative entries
+	Vary        []string        // request headers, cookie:<name> or :method the entry varies on
+	Variant     string          // hash of the Vary values the entry applies to
 	ExpiresAt   time.Time
+
+	matcher *pathPattern // compiled Pattern
+	seq     uint64       // store order; later entries win ties between patterns
+	size    int64        // estimated memory use
+	used    uint64       // last access time, from PathCache.clock; accessed atomically
+	hits    uint64       // lookups served; accessed atomically
+}
+
+// CachedResponse is a platform response kept by the negative cache
+type CachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
 }
 
 // NewPathCache creates a new PathCache instance
 func NewPathCache() *PathCache {
 	return &PathCache{
-		store: make(map[string]*CacheEntry),
+		store:    make(map[string]*CacheEntry),
+		index:    newCacheIndex(),
+		variants: make(map[string]map[string]*CacheEntry),
 	}
 }
\ No newline at end of file
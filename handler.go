@@ -1,127 +1,199 @@
 package flyreplay
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
 )
 
-// ResponseRecorder captures the response from the upstream
-type ResponseRecorder struct {
-	http.ResponseWriter
-	statusCode int
-	body       *bytes.Buffer
-	header     http.Header
-}
-
-// NewResponseRecorder creates a new ResponseRecorder
-func NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
-	return &ResponseRecorder{
-		ResponseWriter: w,
-		body:           new(bytes.Buffer),
-		header:         make(http.Header),
-		statusCode:     http.StatusOK,
-	}
-}
-
-// Header returns the header map
-func (r *ResponseRecorder) Header() http.Header {
-	return r.header
-}
-
-// Write writes the response body
-func (r *ResponseRecorder) Write(p []byte) (int, error) {
-	return r.body.Write(p)
-}
-
-// WriteHeader writes the status code
-func (r *ResponseRecorder) WriteHeader(code int) {
-	r.statusCode = code
-}
-
-// WriteResponse writes the captured response to the original ResponseWriter
-func (r *ResponseRecorder) WriteResponse() error {
-	// Copy headers from recorder to original response
-	for key, values := range r.header {
-		for _, value := range values {
-			r.ResponseWriter.Header().Add(key, value)
-		}
-	}
-
-	// Write status code
-	r.ResponseWriter.WriteHeader(r.statusCode)
-
-	// Write body
-	_, err := r.ResponseWriter.Write(r.body.Bytes())
-	return err
-}
-
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
 func (f *FlyReplay) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 	fullPath := r.Host + r.URL.Path
 
-	// Buffer the request body for potential replay
-	var bodyBytes []byte
-	if r.Body != nil {
-		bodyBytes, _ = io.ReadAll(r.Body)
-		r.Body.Close()
-	}
+	// Only the replay mechanism may set fly-replay-src
+	r.Header.Del("fly-replay-src")
+
+	// Look like Fly's edge to the platform and apps
+	f.setEdgeHeaders(r)
 
 	// Track cache status for fly-replay-cache-status header
 	var cacheStatus string
 
+	// Set while this request asks the platform on behalf of others
+	var leading *flight
+
 	// Step 1: Check cache
 	if f.EnableCache && f.cache != nil {
-		if cached, found := f.cache.Get(fullPath); found {
+		_, lookup := startSpan(r, "cache lookup")
+		cached, found := f.cache.Get(fullPath, r)
+
+		// On a miss, let one request ask the platform and the others
+		// wait for its decision to land in the cache
+		if !found && f.flights != nil {
+			if fl, leader := f.flights.join(f.flightKey(fullPath, r)); leader {
+				leading = fl
+				defer fl.land()
+			} else if f.awaitFlight(r, fl) {
+				cached, found = f.cache.Get(fullPath, r)
+				result := "miss"
+				if found {
+					result = "hit"
+				}
+				f.metrics.coalescedRequests.WithLabelValues(f.metricsHost(r), result).Inc()
+				f.logger.Debug("waited for concurrent platform decision",
+					zap.String("path", fullPath),
+					zap.Bool("cached", found))
+			}
+		}
+
+		if found {
+			match := "wildcard"
+			if cached.Pattern == fullPath {
+				match = "exact"
+			}
+			lookup.SetAttributes(attrCachePattern.String(cached.Pattern))
+			setRouteInfo(r, routeCachePattern, cached.Pattern)
+			setRouteInfo(r, routeCacheMatch, match)
+
 			// Check if client wants to bypass cache and it's allowed
 			if cached.AllowBypass && r.Header.Get("fly-replay-cache-control") == "skip" {
 				// Cache bypass - will continue to platform
 				cacheStatus = "bypass"
-			} else {
+				f.logger.Debug("bypassing route cache",
+					zap.String("path", fullPath),
+					zap.String("pattern", cached.Pattern))
+			} else if cached.Response != nil {
+				// Negative cache hit - answer as the platform did
+				cacheStatus = "hit"
+				f.metrics.cacheRequests.WithLabelValues(f.metricsHost(r), cacheStatus).Inc()
+				setRouteInfo(r, routeCacheStatus, cacheStatus)
+				lookup.SetAttributes(attrCacheStatus.String(cacheStatus))
+				lookup.End()
+				f.logger.Debug("negative cache hit",
+					zap.String("path", fullPath),
+					zap.String("pattern", cached.Pattern),
+					zap.String("match", match),
+					zap.Int("status", cached.Response.StatusCode))
+				return writeCachedResponse(w, cached.Response)
+			} else if _, ok := f.Apps[cached.Target]; ok {
 				// Cache hit - serve from cache
 				cacheStatus = "hit"
-				if f.Debug {
-					w.Header().Set("X-Cached-App", cached.Target)
+				f.metrics.cacheRequests.WithLabelValues(f.metricsHost(r), cacheStatus).Inc()
+				setRouteInfo(r, routeCacheStatus, cacheStatus)
+				lookup.SetAttributes(attrCacheStatus.String(cacheStatus), attrApp.String(cached.Target))
+				lookup.End()
+				for name, value := range cached.matcher.params(fullPath) {
+					setRouteInfo(r, routeParam+name, value)
 				}
+				f.logger.Debug("route cache hit",
+					zap.String("path", fullPath),
+					zap.String("pattern", cached.Pattern),
+					zap.String("match", match),
+					zap.String("app", cached.Target),
+					zap.String("instance", cached.Instance))
 
-				// Restore body for forwarding to cached app
-				if bodyBytes != nil {
-					r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-				}
+				// The app is known, so stream the body straight to it
+				body := streamBody(r)
 
 				// Set cache status header for the app
 				r.Header.Set("fly-replay-cache-status", cacheStatus)
 
 				// Forward directly to cached app
-				if app, ok := f.Apps[cached.Target]; ok {
-					return f.forwardToApp(w, r, app.Domain)
-				}
+				chain := newReplayChain("cache")
+				return f.replay(w, r, &ReplayDirective{App: cached.Target, Instance: cached.Instance}, body, chain, next)
 			}
 		}
-	}
 
-	// Restore body for platform
-	if bodyBytes != nil {
-		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+		if cacheStatus == "" {
+			cacheStatus = "miss"
+		}
+		f.metrics.cacheRequests.WithLabelValues(f.metricsHost(r), cacheStatus).Inc()
+		setRouteInfo(r, routeCacheStatus, cacheStatus)
+		lookup.SetAttributes(attrCacheStatus.String(cacheStatus))
+		lookup.End()
 	}
 
 	// Step 2: Ask platform for routing decision
+	var body *bufferedBody
+	platformReq := r
+	if f.AskPlatformHeadersOnly {
+		// The platform decides on headers alone; the body is streamed to
+		// the app once the platform has answered
+		body = streamBody(r)
+		platformReq = headersOnly(r)
+	} else if requestHasBody(r) {
+		// Buffer the request body so it can be replayed after the
+		// platform has read it
+		if f.MaxBufferSize > 0 && r.ContentLength > f.MaxBufferSize {
+			return caddyhttp.Error(http.StatusRequestEntityTooLarge, errBodyTooLarge)
+		}
+
+		var err error
+		body, err = bufferBody(r.Body, f.MemoryBufferSize, f.MaxBufferSize, f.bufferDir())
+		r.Body.Close()
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		// Restore body for platform
+		body.restore(r)
+	}
+
+	// The platform's spans join the trace under its own span
+	platformReq, decision := startSpan(platformReq, "platform decision")
+	propagateTrace(platformReq)
+
 	rec := NewResponseRecorder(w)
-	err := next.ServeHTTP(rec, r)
+	if f.NegativeCache && f.EnableCache && f.cache != nil {
+		rec.CaptureBody(f.NegativeCacheMaxBody)
+	}
+	if leading != nil {
+		// A response the platform serves itself decides nothing for the
+		// waiting requests; don't hold them while it streams
+		rec.OnPassThrough(leading.land)
+	}
+	start := time.Now()
+	err := next.ServeHTTP(rec, platformReq)
+	f.metrics.platformDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
+		endSpan(decision, err)
 		return err
 	}
 
+	// A handler that returned without writing answered with an empty 200,
+	// which may still carry a fly-replay header
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+
 	// Step 3: Check for replay instruction
-	if replayHeader := rec.Header().Get("fly-replay"); replayHeader != "" {
-		appName := parseAppName(replayHeader)
+	directive, err := rec.ReplayDirective()
+	if directive != nil {
+		decision.SetAttributes(attrDirective.String(directive.String()), attrApp.String(directive.App))
+	}
+	endSpan(decision, err)
+	if err != nil {
+		f.logger.Error("invalid replay directive from platform",
+			zap.String("path", fullPath),
+			zap.Error(err))
+		http.Error(w, fmt.Sprintf("Bad Gateway: invalid replay directive: %v", err), http.StatusBadGateway)
+		return nil
+	}
+	if directive != nil {
+		appName := directive.App
+		f.logger.Debug("platform replay",
+			zap.String("path", fullPath),
+			zap.Stringer("directive", directive),
+			zap.String("cache_status", cacheStatus))
 
 		// Check for cache instruction
 		if f.EnableCache && f.cache != nil {
@@ -129,48 +201,56 @@ func (f *FlyReplay) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddy
 				if cachePattern == "invalidate" {
 					// Platform wants to invalidate cache
 					f.cache.Invalidate(fullPath)
-					if f.Debug {
-						w.Header().Set("X-Cache-Action", "INVALIDATED")
-					}
-				} else {
-					// Platform wants to cache this routing decision
-					ttl := f.CacheTTL // default
-					if ttlHeader := rec.Header().Get("fly-replay-cache-ttl-secs"); ttlHeader != "" {
-						if parsed, err := strconv.Atoi(ttlHeader); err == nil && parsed >= 10 {
-							ttl = parsed
-						}
-					}
-
-					// Check if bypass is allowed
-					allowBypass := false
-					if bypassHeader := rec.Header().Get("fly-replay-cache-allow-bypass"); bypassHeader == "yes" {
-						allowBypass = true
-					}
+					f.metrics.cacheInvalidations.WithLabelValues(f.metricsHost(r)).Inc()
+					f.logger.Debug("route cache entry invalidated",
+						zap.String("pattern", fullPath))
+				} else if directive.Transform == nil && directive.App != "" {
+					// Platform wants to cache this routing decision.
+					// Transformed replays and replays back to the
+					// platform are not cached, since a cache hit only
+					// knows the target app.
+					ttl, allowBypass, vary, err := f.cacheOptions(rec.Header())
 
 					// Cache: pattern -> app mapping
 					cacheKey := r.Host + cachePattern
-					f.cache.Set(fullPath, cacheKey, appName, ttl, allowBypass)
-
-					if f.Debug {
-						w.Header().Set("X-Cache-Action", "STORED")
-						w.Header().Set("X-Cache-Pattern", cacheKey)
-						if allowBypass {
-							w.Header().Set("X-Cache-Allow-Bypass", "yes")
-						}
+					if err == nil {
+						err = f.cache.SetVariant(fullPath, cacheKey, vary, r, appName, directive.Instance, ttl, allowBypass)
+					}
+					if err != nil {
+						// Still replay, just don't remember the decision
+						f.logger.Warn("ignoring fly-replay-cache pattern",
+							zap.String("pattern", cachePattern),
+							zap.Error(err))
+					} else {
+						setRouteInfo(r, routeCachePattern, cacheKey)
+						f.logger.Debug("route cache entry stored",
+							zap.String("pattern", cacheKey),
+							zap.Strings("vary", vary),
+							zap.String("app", appName),
+							zap.String("instance", directive.Instance),
+							zap.Int("ttl_secs", ttl),
+							zap.Bool("allow_bypass", allowBypass))
 					}
 				}
 			}
 		}
 
+		// The decision is cached, if it will be; release the waiting
+		// requests before the replay, which may take a while
+		if leading != nil {
+			leading.land()
+		}
+
 		// Preserve trace ID from platform response if present
 		if traceID := rec.Header().Get("X-Trace-ID"); traceID != "" {
 			r.Header.Set("X-Trace-ID", traceID)
 		}
 
 		// Restore body for forwarding to app
-		if bodyBytes != nil {
-			r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-		}
+		body.restore(r)
+
+		// Hand the platform's state to the app the way Fly does
+		r.Header.Set("fly-replay-src", directive.ReplaySource())
 
 		// Set cache status header for the app
 		if cacheStatus == "bypass" {
@@ -181,55 +261,461 @@ func (f *FlyReplay) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddy
 			r.Header.Set("fly-replay-cache-status", "miss")
 		}
 
+		// On Fly a replay without app= moves the request to another
+		// instance or region of the app that issued it
+		if directive.App == "" {
+			return f.replayToPlatform(w, r, directive, body, next)
+		}
+
 		// Forward to the app
-		if app, ok := f.Apps[appName]; ok {
-			return f.forwardToApp(w, r, app.Domain)
+		return f.replay(w, r, directive, body, newReplayChain("platform"), next)
+	}
+
+	// No replay; the platform's response already streamed to the client,
+	// and is remembered if the platform marked it for the negative cache
+	if resp := rec.CapturedResponse(); resp != nil {
+		f.cacheResponse(r, rec.header, fullPath, resp)
+	}
+	return nil
+}
+
+// cacheOptions reads the fly-replay-cache-* headers of a platform response
+// that asks for a cache entry
+func (f *FlyReplay) cacheOptions(header http.Header) (ttl int, allowBypass bool, vary []string, err error) {
+	ttl = f.CacheTTL // default
+	if ttlHeader := header.Get("fly-replay-cache-ttl-secs"); ttlHeader != "" {
+		if parsed, err := strconv.Atoi(ttlHeader); err == nil && parsed >= 10 {
+			ttl = parsed
 		}
+	}
 
-		http.Error(w, fmt.Sprintf("Bad Gateway: unknown app '%s'", appName), http.StatusBadGateway)
-		return nil
+	// Check if bypass is allowed
+	allowBypass = header.Get("fly-replay-cache-allow-bypass") == "yes"
 
+	// Requests may differ in headers or cookies the platform decided on;
+	// key the entry on their values too
+	vary, err = parseVary(strings.Join(header.Values("fly-replay-cache-vary"), ","))
+	return ttl, allowBypass, vary, err
+}
+
+// cacheResponse stores a platform response marked with fly-replay-cache
+// in the negative cache. Only client errors are cached, and never
+// responses that set cookies, which belong to one client.
+func (f *FlyReplay) cacheResponse(r *http.Request, header http.Header, fullPath string, resp *CachedResponse) {
+	cachePattern := header.Get("fly-replay-cache")
+	if cachePattern == "invalidate" {
+		return
+	}
+	if resp.StatusCode < 400 || resp.StatusCode >= 500 || len(resp.Header.Values("Set-Cookie")) > 0 {
+		f.logger.Warn("ignoring fly-replay-cache on uncacheable platform response",
+			zap.String("pattern", cachePattern),
+			zap.Int("status", resp.StatusCode))
+		return
 	}
 
-	// No replay, return platform's response
-	return rec.WriteResponse()
+	ttl, allowBypass, vary, err := f.cacheOptions(header)
+	cacheKey := r.Host + cachePattern
+	if err == nil {
+		err = f.cache.SetResponse(fullPath, cacheKey, vary, r, resp, ttl, allowBypass)
+	}
+	if err != nil {
+		f.logger.Warn("ignoring fly-replay-cache pattern",
+			zap.String("pattern", cachePattern),
+			zap.Error(err))
+		return
+	}
+
+	setRouteInfo(r, routeCachePattern, cacheKey)
+	f.logger.Debug("negative cache entry stored",
+		zap.String("pattern", cacheKey),
+		zap.Strings("vary", vary),
+		zap.Int("status", resp.StatusCode),
+		zap.Int("ttl_secs", ttl),
+		zap.Bool("allow_bypass", allowBypass))
 }
 
-// parseAppName extracts the app name from the fly-replay header
-func parseAppName(header string) string {
-	// Header format: "app=name" or "app=name;instance=xyz"
-	parts := strings.Split(header, ";")
-	for _, part := range parts {
-		part = strings.TrimSpace(part)
-		if strings.HasPrefix(part, "app=") {
-			return strings.TrimPrefix(part, "app=")
+// writeCachedResponse answers with a response from the negative cache
+func writeCachedResponse(w http.ResponseWriter, resp *CachedResponse) error {
+	for key, values := range resp.Header {
+		w.Header()[key] = slices.Clone(values)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	w.WriteHeader(resp.StatusCode)
+	_, err := w.Write(resp.Body)
+	return err
+}
+
+// replay forwards r to the app named by the directive, applying its
+// transform and timeout first. When the app answers with a replay of its
+// own, that replay is followed too, up to max_replays hops.
+func (f *FlyReplay) replay(w http.ResponseWriter, r *http.Request, directive *ReplayDirective, body *bufferedBody, chain *replayChain, next caddyhttp.Handler) error {
+	// Whoever issued the current directive; prefer_self falls back to it
+	var issuer caddyhttp.Handler = next
+
+	// The app instance that issued the current directive, for elsewhere=true
+	var issuerApp, issuerInstance string
+
+	for {
+		setRouteInfo(r, routeApp, directive.App)
+		if chain.Replays() >= f.MaxReplays {
+			f.visit(r, chain, directive.App, directive.Instance)
+			return f.replayLoop(w, chain, fmt.Sprintf("more than %d replays", f.MaxReplays))
+		}
+
+		// Keep the untransformed request in case we have to fall back
+		var fallback *http.Request
+		if directive.Fallback == ReplayFallbackPreferSelf {
+			fallback = r.Clone(r.Context())
+		}
+
+		if directive.Transform != nil {
+			directive.Transform.Apply(r)
+		}
+
+		app, ok := f.Apps[directive.App]
+		if !ok {
+			f.visit(r, chain, directive.App, directive.Instance)
+			f.metrics.unknownApps.WithLabelValues(directive.App).Inc()
+			f.logger.Warn("replay to unknown app",
+				zap.String("app", directive.App),
+				zap.Stringer("hops", chain))
+			if fallback != nil {
+				return f.replayFallback(w, fallback, body, "unknown app", issuer)
+			}
+			http.Error(w, fmt.Sprintf("Bad Gateway: unknown app '%s'", directive.App), http.StatusBadGateway)
+			return nil
+		}
+
+		var exclude string
+		if directive.Elsewhere && directive.App == issuerApp {
+			exclude = issuerInstance
+		}
+
+		// The timeout bounds this hop, not the lifetime of a tunnel
+		hop, cancel := r, context.CancelFunc(func() {})
+		if directive.Timeout > 0 && !isUpgradeRequest(r) {
+			var ctx context.Context
+			ctx, cancel = context.WithTimeout(r.Context(), directive.Timeout)
+			hop = r.WithContext(ctx)
+		}
+
+		// The app's spans join the trace under this hop's span
+		hop, forward := startSpan(hop, "forward to app",
+			attrApp.String(directive.App),
+			attrCacheStatus.String(r.Header.Get("fly-replay-cache-status")))
+		propagateTrace(hop)
+
+		f.metrics.replays.WithLabelValues(directive.App).Inc()
+		start := time.Now()
+		replayed, served, err := f.forwardToApp(w, hop, app, directive, exclude, body, chain)
+		cancel()
+		f.metrics.appDuration.WithLabelValues(directive.App).Observe(time.Since(start).Seconds())
+		f.visit(r, chain, directive.App, served)
+		setRouteInfo(r, routeInstance, served)
+		forward.SetAttributes(attrInstance.String(served), attrHops.String(chain.String()))
+		endSpan(forward, err)
+		if errors.Is(err, errReplayLoop) {
+			return f.replayLoop(w, chain, "replay loop")
+		}
+		if err != nil && fallback != nil && !errors.Is(err, errInvalidAppReplay) {
+			f.logger.Warn("replay target unreachable, falling back",
+				zap.String("app", directive.App),
+				zap.Error(err))
+			return f.replayFallback(w, fallback, body, "unreachable", issuer)
+		}
+		if err != nil || replayed == nil {
+			return err
+		}
+
+		// The app handed the request on, but it may have read a body
+		// we never kept
+		if !body.replayable() {
+			return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("app %s issued a replay for a request whose body was streamed", directive.App))
+		}
+
+		// A directive without an app targets the app that issued it
+		if replayed.App == "" {
+			replayed.App = directive.App
 		}
+		f.logger.Debug("app replay",
+			zap.String("app", directive.App),
+			zap.String("instance", served),
+			zap.Stringer("directive", replayed))
+		issuerApp, issuerInstance = directive.App, served
+		issuer = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			again, _, err := f.forwardToApp(w, r, app, &ReplayDirective{App: issuerApp, Instance: served}, "", body, nil)
+			if err == nil && again != nil {
+				return f.replayLoop(w, chain, "replayed again after fallback")
+			}
+			return err
+		})
+
+		// Restore body for the next hop
+		body.restore(r)
+		r.Header.Set("fly-replay-src", replayed.ReplaySource())
+		directive = replayed
 	}
-	return ""
 }
 
-// forwardToApp proxies the request to the target app
-func (f *FlyReplay) forwardToApp(w http.ResponseWriter, r *http.Request, targetDomain string) error {
-	// Parse target URL
-	if !strings.HasPrefix(targetDomain, "http://") && !strings.HasPrefix(targetDomain, "https://") {
-		targetDomain = "http://" + targetDomain
+// replayToPlatform sends a platform replay without app back to the
+// platform. The platform is a single local handler, which stands in for all
+// of its instances in the proxy's region; a replay to other regions only is
+// refused. The platform's answer is followed like its first one, except
+// that it may not replay to itself again.
+func (f *FlyReplay) replayToPlatform(w http.ResponseWriter, r *http.Request, directive *ReplayDirective, body *bufferedBody, next caddyhttp.Handler) error {
+	chain := newReplayChain("platform")
+	local := func(region string) bool { return region == f.Region || region == anyRegion }
+	if len(directive.Regions) > 0 && !slices.ContainsFunc(directive.Regions, local) {
+		f.logger.Error("platform replay to another region",
+			zap.Stringer("directive", directive),
+			zap.String("region", f.Region))
+		http.Error(w, fmt.Sprintf("Bad Gateway: the platform has no instance in region %s", strings.Join(directive.Regions, ",")), http.StatusBadGateway)
+		return nil
 	}
+	f.visit(r, chain, "platform", "")
 
-	target, err := url.Parse(targetDomain)
+	if directive.Transform != nil {
+		directive.Transform.Apply(r)
+	}
+	platformReq := r
+	if f.AskPlatformHeadersOnly {
+		platformReq = headersOnly(r)
+	}
+	platformReq, decision := startSpan(platformReq, "platform decision")
+	propagateTrace(platformReq)
+
+	rec := NewResponseRecorder(w)
+	start := time.Now()
+	err := next.ServeHTTP(rec, platformReq)
+	f.metrics.platformDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
-		return fmt.Errorf("invalid target domain: %w", err)
+		endSpan(decision, err)
+		return err
+	}
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
 	}
 
-	// Create reverse proxy
-	proxy := httputil.NewSingleHostReverseProxy(target)
+	replayed, err := rec.ReplayDirective()
+	if replayed != nil {
+		decision.SetAttributes(attrDirective.String(replayed.String()), attrApp.String(replayed.App))
+	}
+	endSpan(decision, err)
+	if err != nil {
+		f.logger.Error("invalid replay directive from platform",
+			zap.Stringer("hops", chain),
+			zap.Error(err))
+		http.Error(w, fmt.Sprintf("Bad Gateway: invalid replay directive: %v", err), http.StatusBadGateway)
+		return nil
+	}
+	if replayed == nil {
+		return nil
+	}
+	if replayed.App == "" {
+		return f.replayLoop(w, chain, "replay loop")
+	}
+	f.logger.Debug("platform replay",
+		zap.Stringer("directive", replayed),
+		zap.Stringer("hops", chain))
 
-	// Add debug headers if enabled
-	if f.Debug {
-		w.Header().Set("X-Forwarded-To", targetDomain)
+	body.restore(r)
+	r.Header.Set("fly-replay-src", replayed.ReplaySource())
+	return f.replay(w, r, replayed, body, chain, next)
+}
+
+// headersOnly is r without its body, for a platform that decides on
+// headers alone
+func headersOnly(r *http.Request) *http.Request {
+	r = r.Clone(r.Context())
+	r.Body = http.NoBody
+	r.ContentLength = 0
+	r.TransferEncoding = nil
+	return r
+}
+
+// isUpgradeRequest reports whether r asks to switch protocols, e.g. to
+// WebSocket. The app that accepts the upgrade gets the connection tunneled
+// to it once the replay is decided.
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
 	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// visit records the hop served by instance of app, and the hops so far
+// for placeholders
+func (f *FlyReplay) visit(r *http.Request, chain *replayChain, app, instance string) {
+	chain.Visit(app, instance)
+	setRouteInfo(r, routeHops, chain.String())
+}
 
-	// Serve the request
-	proxy.ServeHTTP(w, r)
+// replayLoop answers a request whose replays went in circles or too deep
+func (f *FlyReplay) replayLoop(w http.ResponseWriter, chain *replayChain, reason string) error {
+	f.logger.Warn("replay loop",
+		zap.String("reason", reason),
+		zap.Stringer("hops", chain))
+	http.Error(w, fmt.Sprintf("Loop Detected: %s (%s)", reason, chain), http.StatusLoopDetected)
 	return nil
 }
 
+// replayFallback sends the original request back to whoever issued the
+// replay, marked with fly-replay-failed so it knows not to replay again
+func (f *FlyReplay) replayFallback(w http.ResponseWriter, r *http.Request, body *bufferedBody, reason string, issuer caddyhttp.Handler) error {
+	body.restore(r)
+	r.Header.Del("fly-replay-src")
+	r.Header.Del("fly-replay-cache-status")
+	r.Header.Set("fly-replay-failed", reason)
+	return issuer.ServeHTTP(w, r)
+}
+
+// forwardToApp proxies the request to an instance of the app picked by the
+// directive, skipping instances that can't be reached when the directive
+// allows another one to serve it. If the app answers with a replay
+// directive of its own, nothing is written to w and the directive is
+// returned for the caller to follow, along with the instance that issued it.
+//
+// Instances that served an earlier hop of chain are not tried again; when
+// only those are left, errReplayLoop is returned with one of them. chain
+// may be nil.
+func (f *FlyReplay) forwardToApp(w http.ResponseWriter, r *http.Request, app AppConfig, directive *ReplayDirective, exclude string, body *bufferedBody, chain *replayChain) (*ReplayDirective, string, error) {
+	if app.reverseProxy != nil {
+		if chain != nil && chain.Visited(directive.App, "") {
+			return nil, "", errReplayLoop
+		}
+		if directive.Instance != "" {
+			return nil, "", caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("app %s has no named instances", directive.App))
+		}
+		if len(directive.Regions) > 0 && !slices.Contains(directive.Regions, app.Region) && !slices.Contains(directive.Regions, anyRegion) {
+			return nil, "", caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("app %s is not in region %s", directive.App, strings.Join(directive.Regions, ",")))
+		}
+		if err := f.regionDelay(r.Context(), app.Region); err != nil {
+			return nil, "", caddyhttp.Error(http.StatusGatewayTimeout, err)
+		}
+		f.logger.Debug("forwarding to app",
+			zap.String("app", directive.App),
+			zap.String("region", app.Region),
+			zap.String("target", "reverse_proxy"))
+		replayed, err := f.forwardToReverseProxy(w, r, app)
+		return replayed, "", err
+	}
+
+	candidates, err := app.candidates(directive, exclude)
+	if err != nil {
+		return nil, "", caddyhttp.Error(http.StatusBadGateway, err)
+	}
+	if chain != nil {
+		first := candidates[0]
+		candidates = slices.DeleteFunc(candidates, func(inst *appInstance) bool {
+			return chain.Visited(directive.App, inst.id)
+		})
+		if len(candidates) == 0 {
+			return nil, first.id, errReplayLoop
+		}
+	}
+
+	for i, inst := range candidates {
+		// Restore body for another attempt; a streamed body may already
+		// be gone
+		if i > 0 {
+			if !body.replayable() {
+				break
+			}
+			body.restore(r)
+		}
+
+		if err = f.regionDelay(r.Context(), inst.region); err != nil {
+			break
+		}
+
+		f.logger.Debug("forwarding to app",
+			zap.String("app", directive.App),
+			zap.String("instance", inst.id),
+			zap.String("region", inst.region),
+			zap.String("target", inst.target.String()))
+
+		var replayed *ReplayDirective
+		replayed, err = f.forwardToInstance(w, r, inst)
+		if err == nil {
+			return replayed, inst.id, nil
+		}
+
+		// The instance answered; another one won't fix its replay
+		if errors.Is(err, errInvalidAppReplay) {
+			return nil, inst.id, caddyhttp.Error(http.StatusBadGateway, err)
+		}
+
+		// Out of time; another instance won't do better
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			break
+		}
+		f.logger.Warn("app instance unreachable",
+			zap.String("app", directive.App),
+			zap.String("instance", inst.id),
+			zap.Error(err))
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, "", caddyhttp.Error(http.StatusGatewayTimeout, err)
+	}
+	return nil, "", caddyhttp.Error(http.StatusBadGateway, err)
+}
+
+// forwardToInstance proxies the request to one instance of an app. Nothing
+// has been written to w when it returns an error.
+func (f *FlyReplay) forwardToInstance(w http.ResponseWriter, r *http.Request, inst *appInstance) (*ReplayDirective, error) {
+
+	// Serve the request through the instance's proxy
+	state := new(forwardState)
+	inst.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), forwardStateKey{}, state)))
+
+	if state.replayErr != nil {
+		return nil, state.replayErr
+	}
+	if state.err != nil && !errors.Is(state.err, errAppReplayed) {
+		return nil, state.err
+	}
+	return state.replayed, nil
+}
+
+// forwardToReverseProxy hands the request to the app's reverse_proxy
+// handler, holding back responses that carry a replay directive
+func (f *FlyReplay) forwardToReverseProxy(w http.ResponseWriter, r *http.Request, app AppConfig) (*ReplayDirective, error) {
+
+	rec := NewResponseRecorder(w)
+	err := app.reverseProxy.ServeHTTP(rec, r, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+
+	directive, err := rec.ReplayDirective()
+	if err != nil {
+		return nil, caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("%w: %w", errInvalidAppReplay, err))
+	}
+	return directive, nil
+}
+
+// errAppReplayed stops the proxy from writing a response the app
+// replaced with a replay directive
+var errAppReplayed = errors.New("app issued a replay")
+
+// errReplayLoop reports a replay whose every candidate instance already
+// served the request
+var errReplayLoop = errors.New("replay loop")
+
+// errInvalidAppReplay marks a replay directive from an app that doesn't
+// parse. The app was reached, so the request is neither retried on another
+// instance nor sent back with prefer_self.
+var errInvalidAppReplay = errors.New("invalid replay directive")
@@ -0,0 +1,397 @@
+package flyreplay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// provision provisions f the way Caddy would, and cleans it up when the
+// test ends
+func provision(t *testing.T, f *FlyReplay) *FlyReplay {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := f.Provision(ctx); err != nil {
+		t.Fatalf("Provision() error = %v", err)
+	}
+	t.Cleanup(func() {
+		if err := f.Cleanup(); err != nil {
+			t.Errorf("Cleanup() error = %v", err)
+		}
+	})
+	return f
+}
+
+// testApp starts an app server and returns its address
+func testApp(t *testing.T, handler http.HandlerFunc) string {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// testPlatform is a platform handler that counts its calls
+type testPlatform struct {
+	calls atomic.Int32
+	serve func(w http.ResponseWriter, r *http.Request)
+}
+
+func (p *testPlatform) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	p.calls.Add(1)
+	p.serve(w, r)
+	return nil
+}
+
+// serve sends r through f, answering a returned error with its status the
+// way Caddy would
+func serve(t *testing.T, f *FlyReplay, next caddyhttp.Handler, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	if err := f.ServeHTTP(w, r, next); err != nil {
+		var herr caddyhttp.HandlerError
+		if !errors.As(err, &herr) {
+			t.Errorf("ServeHTTP() error = %v", err)
+		}
+		w.Code = herr.StatusCode
+	}
+	return w
+}
+
+// get is a GET request for target
+func get(target string) *http.Request {
+	return httptest.NewRequest("GET", target, nil)
+}
+
+func TestServeHTTPNegativeCache(t *testing.T) {
+	f := provision(t, &FlyReplay{EnableCache: true, NegativeCache: true, NegativeCacheMaxBody: 64})
+	platform := &testPlatform{serve: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("fly-replay-cache", "/missing/*")
+		w.Header().Set("fly-replay-cache-ttl-secs", "60")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Reason", "unknown tenant")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("no such tenant"))
+	}}
+
+	for i, path := range []string{"/missing/a", "/missing/b"} {
+		w := serve(t, f, platform, get("http://example.com"+path))
+		if w.Code != http.StatusNotFound || w.Body.String() != "no such tenant" {
+			t.Errorf("request %d: got %d %q, want the platform's 404", i, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("X-Reason"); got != "unknown tenant" {
+			t.Errorf("request %d: X-Reason = %q", i, got)
+		}
+		if got := w.Header().Get("Content-Type"); got != "text/plain" {
+			t.Errorf("request %d: Content-Type = %q", i, got)
+		}
+		for key := range w.Header() {
+			if strings.HasPrefix(strings.ToLower(key), "fly-replay-cache") && key != "Fly-Replay-Cache-Status" {
+				t.Errorf("request %d: client got %s", i, key)
+			}
+		}
+	}
+	if got := platform.calls.Load(); got != 1 {
+		t.Errorf("platform called %d times, want the second request answered from the cache", got)
+	}
+	if entry, ok := f.cache.Get("example.com/missing/c", nil); !ok || entry.Response == nil {
+		t.Errorf("no negative cache entry for example.com/missing/*")
+	}
+}
+
+func TestServeHTTPNegativeCacheRefuses(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		body   string
+	}{
+		{"success", http.StatusOK, nil, "ok"},
+		{"server error", http.StatusInternalServerError, nil, "try later"},
+		{"cookie", http.StatusNotFound, http.Header{"Set-Cookie": {"sid=1"}}, "no such tenant"},
+		{"oversized body", http.StatusNotFound, nil, strings.Repeat("x", 65)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := provision(t, &FlyReplay{EnableCache: true, NegativeCache: true, NegativeCacheMaxBody: 64})
+			platform := &testPlatform{serve: func(w http.ResponseWriter, r *http.Request) {
+				for key, values := range tt.header {
+					w.Header()[key] = values
+				}
+				w.Header().Set("fly-replay-cache", "/missing/*")
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}}
+
+			for range 2 {
+				w := serve(t, f, platform, get("http://example.com/missing/a"))
+				if w.Code != tt.status || w.Body.String() != tt.body {
+					t.Errorf("got %d %q, want the platform's response", w.Code, w.Body.String())
+				}
+			}
+			if got := platform.calls.Load(); got != 2 {
+				t.Errorf("platform called %d times, want 2", got)
+			}
+			if f.cache.Len() != 0 {
+				t.Errorf("cache holds %d entries, want none", f.cache.Len())
+			}
+		})
+	}
+}
+
+func TestServeHTTPReplaysToApp(t *testing.T) {
+	addr := testApp(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Replay-Src", r.Header.Get("fly-replay-src"))
+		w.Write([]byte("web"))
+	})
+	f := provision(t, &FlyReplay{Apps: map[string]AppConfig{"web": {Domain: addr}}})
+	platform := &testPlatform{serve: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("fly-replay", "app=web;state=t1")
+		w.WriteHeader(http.StatusOK)
+	}}
+
+	w := serve(t, f, platform, get("http://example.com/a"))
+	if w.Code != http.StatusOK || w.Body.String() != "web" {
+		t.Fatalf("got %d %q, want the app's response", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-Replay-Src"); !strings.Contains(got, "state=t1") {
+		t.Errorf("app got fly-replay-src %q, want the platform's state", got)
+	}
+}
+
+// replayingApp starts an app that answers every request with a replay
+func replayingApp(t *testing.T, directive string) string {
+	return testApp(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("fly-replay", directive)
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// answeringApp starts an app that answers every request with body
+func answeringApp(t *testing.T, body string) string {
+	return testApp(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+}
+
+// replayingPlatform is a platform that answers every request with a replay
+func replayingPlatform(directive string) *testPlatform {
+	return &testPlatform{serve: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("fly-replay", directive)
+		w.WriteHeader(http.StatusOK)
+	}}
+}
+
+func TestServeHTTPFollowsAppReplays(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxReplays int
+		wantCode   int
+		wantBody   string
+	}{
+		{"within max_replays", 3, http.StatusOK, "c"},
+		{"beyond max_replays", 2, http.StatusLoopDetected, "more than 2 replays (platform -> a -> b -> c)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := provision(t, &FlyReplay{
+				MaxReplays: tt.maxReplays,
+				Apps: map[string]AppConfig{
+					"a": {Domain: replayingApp(t, "app=b")},
+					"b": {Domain: replayingApp(t, "app=c")},
+					"c": {Domain: answeringApp(t, "c")},
+				},
+			})
+			w := serve(t, f, replayingPlatform("app=a"), get("http://example.com/"))
+			if w.Code != tt.wantCode || !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("got %d %q, want %d %q", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestServeHTTPReplayLoop(t *testing.T) {
+	f := provision(t, &FlyReplay{Apps: map[string]AppConfig{
+		"a": {Domain: replayingApp(t, "app=b")},
+		"b": {Domain: replayingApp(t, "app=a")},
+	}})
+	w := serve(t, f, replayingPlatform("app=a"), get("http://example.com/"))
+	if want := "replay loop (platform -> a -> b -> a)"; w.Code != http.StatusLoopDetected || !strings.Contains(w.Body.String(), want) {
+		t.Errorf("got %d %q, want 508 %q", w.Code, w.Body.String(), want)
+	}
+}
+
+func TestServeHTTPReplayWithinApp(t *testing.T) {
+	for _, directive := range []string{"elsewhere=true", "app=a", "app=a;prefer_instance=i1"} {
+		t.Run(directive, func(t *testing.T) {
+			var served atomic.Int32
+			f := provision(t, &FlyReplay{Apps: map[string]AppConfig{
+				"a": {Instances: map[string]InstanceConfig{
+					"i1": {Address: testApp(t, func(w http.ResponseWriter, r *http.Request) {
+						served.Add(1)
+						w.Header().Set("fly-replay", directive)
+						w.WriteHeader(http.StatusOK)
+					})},
+					"i2": {Address: answeringApp(t, "i2")},
+				}},
+			}})
+
+			// A replay to the app that issued it goes to another instance
+			w := serve(t, f, replayingPlatform("app=a;prefer_instance=i1"), get("http://example.com/"))
+			if w.Code != http.StatusOK || w.Body.String() != "i2" {
+				t.Errorf("got %d %q, want i2's response", w.Code, w.Body.String())
+			}
+			if got := served.Load(); got != 1 {
+				t.Errorf("i1 served %d times, want 1", got)
+			}
+		})
+	}
+}
+
+func TestServeHTTPReplayLoopWithinApp(t *testing.T) {
+	var served [2]atomic.Int32
+	instance := func(i int) InstanceConfig {
+		return InstanceConfig{Address: testApp(t, func(w http.ResponseWriter, r *http.Request) {
+			served[i].Add(1)
+			w.Header().Set("fly-replay", "app=a")
+			w.WriteHeader(http.StatusOK)
+		})}
+	}
+	f := provision(t, &FlyReplay{Apps: map[string]AppConfig{
+		"a": {Instances: map[string]InstanceConfig{"i1": instance(0), "i2": instance(1)}},
+	}})
+
+	w := serve(t, f, replayingPlatform("app=a"), get("http://example.com/"))
+	if w.Code != http.StatusLoopDetected || !strings.Contains(w.Body.String(), "replay loop") {
+		t.Errorf("got %d %q, want a 508 replay loop", w.Code, w.Body.String())
+	}
+	if served[0].Load() != 1 || served[1].Load() != 1 {
+		t.Errorf("instances served %d and %d times, want once each", served[0].Load(), served[1].Load())
+	}
+}
+
+func TestServeHTTPReplayAcrossRegions(t *testing.T) {
+	tests := []struct {
+		directive string // syd1's replay
+		want      string
+	}{
+		{"region=ams", "ams1"},
+		{"region=syd", "syd2"},
+		{"region=syd,ams;elsewhere=true", "syd2"},
+		{"app=a;region=ams", "ams1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.directive, func(t *testing.T) {
+			f := provision(t, &FlyReplay{Region: "syd", Apps: map[string]AppConfig{
+				"a": {Instances: map[string]InstanceConfig{
+					"syd1": {Address: replayingApp(t, tt.directive), Region: "syd"},
+					"syd2": {Address: answeringApp(t, "syd2"), Region: "syd"},
+					"ams1": {Address: answeringApp(t, "ams1"), Region: "ams"},
+				}},
+			}})
+			w := serve(t, f, replayingPlatform("app=a;region=syd;prefer_instance=syd1"), get("http://example.com/"))
+			if w.Code != http.StatusOK || w.Body.String() != tt.want {
+				t.Errorf("got %d %q, want %s's response", w.Code, w.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPReplayToPlatform(t *testing.T) {
+	tests := []struct {
+		name      string
+		directive string // the platform's first replay
+		second    string // its replay of the replayed request
+		wantCode  int
+		wantBody  string
+	}{
+		{"local region", "region=syd;state=t1", "", http.StatusOK, "state=t1"},
+		{"any region", "region=ams,any;state=t1", "", http.StatusOK, "state=t1"},
+		{"elsewhere", "elsewhere=true", "app=a", http.StatusOK, "a"},
+		{"other region", "region=ams", "", http.StatusBadGateway, "no instance in region ams"},
+		{"loop", "region=syd", "region=syd", http.StatusLoopDetected, "replay loop (platform -> platform)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := provision(t, &FlyReplay{Region: "syd", Apps: map[string]AppConfig{
+				"a": {Domain: answeringApp(t, "a")},
+			}})
+			platform := &testPlatform{serve: func(w http.ResponseWriter, r *http.Request) {
+				src := r.Header.Get("fly-replay-src")
+				switch {
+				case src == "":
+					w.Header().Set("fly-replay", tt.directive)
+				case tt.second != "":
+					w.Header().Set("fly-replay", tt.second)
+				default:
+					w.Write([]byte("platform got " + src))
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}}
+
+			w := serve(t, f, platform, get("http://example.com/"))
+			if w.Code != tt.wantCode || !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("got %d %q, want %d %q", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestServeHTTPPassesTrailers(t *testing.T) {
+	f := provision(t, &FlyReplay{})
+	platform := &testPlatform{serve: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("platform"))
+		w.Header().Set("Grpc-Status", "0")
+	}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := f.ServeHTTP(w, r, platform); err != nil {
+			t.Errorf("ServeHTTP() error = %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "platform" {
+		t.Errorf("body = %q, want the platform's", body)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("Grpc-Status trailer = %q, want 0", got)
+	}
+}
+
+func TestServeHTTPSpillsBodyToCacheDir(t *testing.T) {
+	addr := testApp(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+	dir := filepath.Join(t.TempDir(), "spill")
+	f := provision(t, &FlyReplay{
+		CacheDir:         dir,
+		MemoryBufferSize: 4,
+		Apps:             map[string]AppConfig{"echo": {Domain: addr}},
+	})
+
+	w := serve(t, f, replayingPlatform("app=echo"), httptest.NewRequest("POST", "http://example.com/", strings.NewReader("larger than memory")))
+	if w.Code != http.StatusOK || w.Body.String() != "larger than memory" {
+		t.Errorf("got %d %q, want the body echoed", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("cache_dir not created without enable_cache: %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package flyreplay
+
+import "strings"
+
+// cacheIndex finds the pattern entries that may match a path without
+// looking at every entry. Each pattern is filed under its literal prefix
+// (everything before the first wildcard) in a trie per host; entries with
+// a literal suffix (everything after the last wildcard) hang off the
+// prefix's node in a second trie over the reversed suffix. A lookup walks
+// the path once through the prefix trie, and at each node on the way walks
+// the path backwards through the suffix trie, so its cost depends on the
+// path length and the number of overlapping patterns, not on the size of
+// the cache.
+//
+// The index only narrows down candidates; they still have to match.
+// Plain literal patterns that don't vary are found in PathCache.store
+// directly and are not indexed.
+type cacheIndex struct {
+	hosts map[string]*indexNode // literal host -> trie over the rest of the prefix
+	other *indexNode            // patterns whose literal prefix ends before the path, over the whole prefix
+}
+
+// indexNode is a node of a byte-wise trie
+type indexNode struct {
+	children map[byte]*indexNode
+	entries  []*CacheEntry // entries whose literal prefix (or reversed suffix) ends here
+	suffixes *indexNode    // entries whose literal prefix ends here and have a literal suffix
+}
+
+func newCacheIndex() *cacheIndex {
+	return &cacheIndex{
+		hosts: make(map[string]*indexNode),
+		other: new(indexNode),
+	}
+}
+
+// splitHost splits a cache key like "example.com/en-US/*" at the first
+// slash. ok is false when there is no slash.
+func splitHost(key string) (host, rest string, ok bool) {
+	i := strings.IndexByte(key, '/')
+	if i < 0 {
+		return "", key, false
+	}
+	return key[:i], key[i:], true
+}
+
+// root returns the trie a literal prefix is filed in and the part of the
+// prefix the trie is keyed on. With create false it returns nil when the
+// host has no trie yet.
+func (x *cacheIndex) root(prefix string, create bool) (*indexNode, string) {
+	host, rest, ok := splitHost(prefix)
+	if !ok {
+		return x.other, prefix
+	}
+	n, found := x.hosts[host]
+	if !found && create {
+		n = new(indexNode)
+		x.hosts[host] = n
+	}
+	return n, rest
+}
+
+// indexed reports whether entry needs the index to be found, i.e. it has
+// wildcards or escapes, or varies so its store key isn't the path
+func indexed(entry *CacheEntry) bool {
+	return entry.matcher.wildcards > 0 || entry.matcher.prefix != entry.Pattern || entry.Variant != ""
+}
+
+// add files an entry under its literal prefix and suffix
+func (x *cacheIndex) add(entry *CacheEntry) {
+	if !indexed(entry) {
+		return
+	}
+	prefix, suffix := entry.matcher.prefix, entry.matcher.suffix
+
+	n, key := x.root(prefix, true)
+	n = n.descend(key, false)
+	if suffix == "" {
+		n.entries = append(n.entries, entry)
+		return
+	}
+	if n.suffixes == nil {
+		n.suffixes = new(indexNode)
+	}
+	s := n.suffixes.descend(suffix, true)
+	s.entries = append(s.entries, entry)
+}
+
+// remove takes entry out of the index
+func (x *cacheIndex) remove(entry *CacheEntry) {
+	if !indexed(entry) {
+		return
+	}
+	prefix, suffix := entry.matcher.prefix, entry.matcher.suffix
+
+	n, key := x.root(prefix, false)
+	if n == nil {
+		return
+	}
+	if n.remove(key, suffix, entry) && n != x.other {
+		host, _, _ := splitHost(prefix)
+		delete(x.hosts, host)
+	}
+}
+
+// candidates returns the entries whose literal prefix and suffix both fit
+// fullPath
+func (x *cacheIndex) candidates(fullPath string) []*CacheEntry {
+	var found []*CacheEntry
+	if host, rest, ok := splitHost(fullPath); ok {
+		if n := x.hosts[host]; n != nil {
+			found = n.collect(rest, fullPath, found)
+		}
+	}
+	return x.other.collect(fullPath, fullPath, found)
+}
+
+// descend walks key from n, creating missing nodes, and returns the last
+// node. With reverse set key is walked from its end.
+func (n *indexNode) descend(key string, reverse bool) *indexNode {
+	for i := range len(key) {
+		c := key[i]
+		if reverse {
+			c = key[len(key)-1-i]
+		}
+		child := n.children[c]
+		if child == nil {
+			if n.children == nil {
+				n.children = make(map[byte]*indexNode)
+			}
+			child = new(indexNode)
+			n.children[c] = child
+		}
+		n = child
+	}
+	return n
+}
+
+// collect appends the entries filed under every prefix of key, checking
+// suffixes against the end of fullPath
+func (n *indexNode) collect(key, fullPath string, found []*CacheEntry) []*CacheEntry {
+	for i := 0; n != nil; i++ {
+		found = append(found, n.entries...)
+		if n.suffixes != nil {
+			found = n.suffixes.collectSuffix(fullPath, found)
+		}
+		if i == len(key) {
+			break
+		}
+		n = n.children[key[i]]
+	}
+	return found
+}
+
+// collectSuffix appends the entries filed under every suffix of s
+func (n *indexNode) collectSuffix(s string, found []*CacheEntry) []*CacheEntry {
+	for i := len(s) - 1; i >= 0; i-- {
+		n = n.children[s[i]]
+		if n == nil {
+			break
+		}
+		found = append(found, n.entries...)
+	}
+	return found
+}
+
+// remove deletes entry, filed under key and suffix, pruning nodes left
+// empty. It reports whether n itself is now empty.
+func (n *indexNode) remove(key, suffix string, entry *CacheEntry) bool {
+	if key != "" {
+		child := n.children[key[0]]
+		if child != nil && child.remove(key[1:], suffix, entry) {
+			delete(n.children, key[0])
+		}
+		return n.empty()
+	}
+
+	if suffix == "" {
+		n.entries = removeEntry(n.entries, entry)
+	} else if n.suffixes != nil && n.suffixes.removeSuffix(suffix, entry) {
+		n.suffixes = nil
+	}
+	return n.empty()
+}
+
+// removeSuffix is remove for the reversed suffix trie
+func (n *indexNode) removeSuffix(suffix string, entry *CacheEntry) bool {
+	if suffix == "" {
+		n.entries = removeEntry(n.entries, entry)
+		return n.empty()
+	}
+	last := suffix[len(suffix)-1]
+	child := n.children[last]
+	if child != nil && child.removeSuffix(suffix[:len(suffix)-1], entry) {
+		delete(n.children, last)
+	}
+	return n.empty()
+}
+
+// empty reports whether n holds nothing and can be pruned
+func (n *indexNode) empty() bool {
+	return len(n.children) == 0 && len(n.entries) == 0 && n.suffixes == nil
+}
+
+// removeEntry removes entry from entries
+func removeEntry(entries []*CacheEntry, entry *CacheEntry) []*CacheEntry {
+	for i, e := range entries {
+		if e == entry {
+			return append(entries[:i], entries[i+1:]...)
+		}
+	}
+	return entries
+}
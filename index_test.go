@@ -0,0 +1,132 @@
+package flyreplay
+
+import (
+	"slices"
+	"testing"
+)
+
+// testEntry returns an entry for pattern as the cache would store it
+func testEntry(t testing.TB, pattern string) *CacheEntry {
+	t.Helper()
+	matcher, err := compilePattern(pattern)
+	if err != nil {
+		t.Fatalf("compilePattern(%q) error = %v", pattern, err)
+	}
+	return &CacheEntry{Pattern: pattern, matcher: matcher}
+}
+
+// candidatePatterns returns the patterns of the candidates for fullPath,
+// sorted
+func candidatePatterns(x *cacheIndex, fullPath string) []string {
+	var patterns []string
+	for _, entry := range x.candidates(fullPath) {
+		patterns = append(patterns, entry.Pattern)
+	}
+	slices.Sort(patterns)
+	return patterns
+}
+
+func TestCacheIndexCandidates(t *testing.T) {
+	x := newCacheIndex()
+	for _, pattern := range []string{
+		"example.com/en-US/*",
+		"example.com/en-US/user1/*",
+		"example.com/files/*/avatar.png",
+		"example.com/files/*.png",
+		"example.com/**",
+		"example.com/**/c",
+		"other.com/en-US/*",
+		`example.com/a\*b`,
+	} {
+		x.add(testEntry(t, pattern))
+	}
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"example.com/en-US/user1/profile", []string{
+			"example.com/**",
+			"example.com/en-US/*",
+			"example.com/en-US/user1/*",
+		}},
+		{"example.com/files/x/avatar.png", []string{
+			"example.com/**",
+			"example.com/files/*.png",
+			"example.com/files/*/avatar.png",
+		}},
+		{"example.com/files/x/avatar.jpg", []string{
+			"example.com/**",
+		}},
+		{"example.com/a/b/c", []string{
+			"example.com/**",
+			"example.com/**/c",
+		}},
+		{"example.com/a*b", []string{
+			"example.com/**",
+			`example.com/a\*b`,
+		}},
+		{"other.com/en-US/x", []string{
+			"other.com/en-US/*",
+		}},
+		{"unknown.com/en-US/x", nil},
+	}
+	for _, tt := range tests {
+		if got := candidatePatterns(x, tt.path); !slices.Equal(got, tt.want) {
+			t.Errorf("candidates(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCacheIndexSkipsLiterals(t *testing.T) {
+	x := newCacheIndex()
+	x.add(testEntry(t, "example.com/a/b"))
+	if got := x.candidates("example.com/a/b"); len(got) != 0 {
+		t.Errorf("a plain literal pattern was indexed: %v", got)
+	}
+
+	// Varied entries are stored under their variant, so they need the index
+	entry := testEntry(t, "example.com/a/b")
+	entry.Variant = "0123"
+	x.add(entry)
+	if got := x.candidates("example.com/a/b"); len(got) != 1 || got[0] != entry {
+		t.Errorf("candidates() = %v, want the varied entry", got)
+	}
+}
+
+func TestCacheIndexRemovePrunes(t *testing.T) {
+	x := newCacheIndex()
+	var entries []*CacheEntry
+	for _, pattern := range []string{
+		"example.com/en-US/*",
+		"example.com/en-US/user1/*",
+		"example.com/files/*/avatar.png",
+		"example.com/files/*/user1/avatar.png",
+		"example.com/**",
+		"other.com/**/c",
+	} {
+		entry := testEntry(t, pattern)
+		x.add(entry)
+		entries = append(entries, entry)
+	}
+
+	// Removing one entry leaves the others sharing its nodes
+	x.remove(entries[3])
+	want := []string{"example.com/**", "example.com/files/*/avatar.png"}
+	if got := candidatePatterns(x, "example.com/files/x/user1/avatar.png"); !slices.Equal(got, want) {
+		t.Errorf("candidates() after remove = %q, want %q", got, want)
+	}
+
+	// Removing one twice does nothing
+	x.remove(entries[3])
+
+	for _, entry := range entries {
+		x.remove(entry)
+	}
+	if len(x.hosts) != 0 {
+		t.Errorf("hosts left after removing every entry: %v", x.hosts)
+	}
+	if !x.other.empty() {
+		t.Errorf("other trie not pruned after removing every entry")
+	}
+}
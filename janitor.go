@@ -0,0 +1,63 @@
+package flyreplay
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultCleanupInterval is how often expired cache entries are swept when
+// cleanup_interval isn't set
+const defaultCleanupInterval = time.Minute
+
+// cacheSaveInterval is how often a changed route cache is written to
+// cache_dir. Requests only mark the cache changed, so they never wait on
+// the disk.
+const cacheSaveInterval = 5 * time.Second
+
+// runJanitor sweeps expired entries from the route cache every interval
+// and writes the cache to cache_dir when it changed, until stop is closed
+func (f *FlyReplay) runJanitor(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	saveTicker := time.NewTicker(cacheSaveInterval)
+	defer saveTicker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if expired := f.cache.Clean(); expired > 0 {
+				f.logger.Debug("route cache entries expired",
+					zap.Int("count", expired),
+					zap.Int("remaining", f.cache.Len()))
+			}
+		case <-saveTicker.C:
+			f.saveCache()
+		}
+	}
+}
+
+// saveCache writes the route cache to cache_dir when configured and
+// changed. Persistence is best effort: a failed write only costs a relearn
+// after restart, and is retried on the next tick.
+func (f *FlyReplay) saveCache() {
+	if f.cacheFile == "" || !f.cache.Dirty() {
+		return
+	}
+	if err := f.cache.Save(f.cacheFile); err != nil {
+		f.logger.Error("saving route cache", zap.Error(err))
+	}
+}
+
+// cacheEvicted counts and logs an entry the cache removed on its own
+func (f *FlyReplay) cacheEvicted(entry *CacheEntry, reason string) {
+	f.metrics.cacheEvictions.WithLabelValues(reason).Inc()
+	if reason != evictedExpired {
+		f.logger.Debug("route cache entry evicted",
+			zap.String("pattern", entry.Pattern),
+			zap.String("app", entry.Target),
+			zap.String("reason", reason))
+	}
+}
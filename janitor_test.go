@@ -0,0 +1,44 @@
+package flyreplay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+)
+
+func TestJanitorSweepsExpired(t *testing.T) {
+	metrics, err := newReplayMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &FlyReplay{logger: zap.NewNop(), metrics: metrics, cache: NewPathCache()}
+	f.cache.SetLimits(0, 0, EvictLRU, f.cacheEvicted)
+	if err := f.cache.Set("example.com/live/*", "example.com/live/*", "app", "", 60, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.cache.Set("example.com/expired/*", "example.com/expired/*", "app", "", 0, false); err != nil {
+		t.Fatal(err)
+	}
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		f.runJanitor(time.Millisecond, stop)
+		close(stopped)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); f.cache.Len() > 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("janitor left %d entries, want 1", f.cache.Len())
+		}
+	}
+	close(stop)
+	<-stopped
+
+	var m dto.Metric
+	f.metrics.cacheEvictions.WithLabelValues(evictedExpired).Write(&m)
+	if got := m.GetCounter().GetValue(); got != 1 {
+		t.Errorf("expired evictions = %v, want 1", got)
+	}
+}
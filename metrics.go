@@ -0,0 +1,203 @@
+package flyreplay
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metric names follow Caddy's own caddy_http_* naming
+const (
+	metricsNamespace = "caddy"
+	metricsSubsystem = "fly_replay"
+)
+
+// replayMetrics holds the collectors of one FlyReplay handler. Handlers in
+// the same config share collectors through the config's registry.
+type replayMetrics struct {
+	cacheRequests      *prometheus.CounterVec
+	cacheInvalidations *prometheus.CounterVec
+	cacheEvictions     *prometheus.CounterVec
+	coalescedRequests  *prometheus.CounterVec
+	replays            *prometheus.CounterVec
+	unknownApps        *prometheus.CounterVec
+	platformDuration   prometheus.Histogram
+	appDuration        *prometheus.HistogramVec
+	cacheEntries       *cacheEntriesCollector
+}
+
+// newReplayMetrics registers the collectors with registry, reusing the
+// ones another handler registered already
+func newReplayMetrics(registry prometheus.Registerer) (*replayMetrics, error) {
+	m := &replayMetrics{}
+	var err error
+
+	m.cacheRequests, err = register(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "cache_requests_total",
+		Help:      "Requests by route cache outcome (hit, miss or bypass).",
+	}, []string{"host", "result"}))
+	if err != nil {
+		return nil, err
+	}
+
+	m.cacheInvalidations, err = register(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "cache_invalidations_total",
+		Help:      "Route cache entries invalidated by the platform.",
+	}, []string{"host"}))
+	if err != nil {
+		return nil, err
+	}
+
+	m.cacheEvictions, err = register(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "cache_evictions_total",
+		Help:      "Route cache entries removed by the cache itself (expired, max_entries or max_memory).",
+	}, []string{"reason"}))
+	if err != nil {
+		return nil, err
+	}
+
+	m.coalescedRequests, err = register(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "coalesced_requests_total",
+		Help:      "Cache misses that waited for a concurrent platform call, by outcome (hit, miss or timeout).",
+	}, []string{"host", "result"}))
+	if err != nil {
+		return nil, err
+	}
+
+	m.replays, err = register(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "replays_total",
+		Help:      "Requests replayed to an app, from the cache, the platform or another app.",
+	}, []string{"app"}))
+	if err != nil {
+		return nil, err
+	}
+
+	m.unknownApps, err = register(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "unknown_app_total",
+		Help:      "Replays to an app that is not configured.",
+	}, []string{"app"}))
+	if err != nil {
+		return nil, err
+	}
+
+	m.platformDuration, err = register(registry, prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "platform_duration_seconds",
+		Help:      "Time the platform took to answer, including responses it served itself.",
+		Buckets:   prometheus.DefBuckets,
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	m.appDuration, err = register(registry, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "app_duration_seconds",
+		Help:      "Time an app took to serve a replayed request.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"app"}))
+	if err != nil {
+		return nil, err
+	}
+
+	m.cacheEntries, err = register(registry, &cacheEntriesCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "cache_entries"),
+			"Entries currently held in the route cache.",
+			nil, nil,
+		),
+		caches: make(map[*PathCache]struct{}),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// register registers c, or returns the equivalent collector that is
+// already registered
+func register[T prometheus.Collector](registry prometheus.Registerer, c T) (T, error) {
+	if err := registry.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(T); ok {
+				return existing, nil
+			}
+		}
+		return c, err
+	}
+	return c, nil
+}
+
+// cacheEntriesCollector reports the total size of every route cache in
+// the config as a single gauge
+type cacheEntriesCollector struct {
+	desc *prometheus.Desc
+
+	mu     sync.Mutex
+	caches map[*PathCache]struct{}
+}
+
+// Describe implements prometheus.Collector.
+func (c *cacheEntriesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector.
+func (c *cacheEntriesCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	total := 0
+	for cache := range c.caches {
+		total += cache.Len()
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(total))
+}
+
+// add starts counting the entries of cache
+func (c *cacheEntriesCollector) add(cache *PathCache) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.caches[cache] = struct{}{}
+}
+
+// remove stops counting the entries of cache
+func (c *cacheEntriesCollector) remove(cache *PathCache) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.caches, cache)
+}
+
+// metricsHost returns the host label for r: its host without the port
+// with metrics_per_host, empty otherwise so the label's values stay bounded.
+// PromQL treats an empty label like a missing one.
+func (f *FlyReplay) metricsHost(r *http.Request) string {
+	if !f.MetricsPerHost {
+		return ""
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
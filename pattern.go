@@ -0,0 +1,315 @@
+package flyreplay
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Limits on patterns accepted from the platform
+const (
+	maxPatternLength    = 1024
+	maxPatternWildcards = 8
+)
+
+// pathPattern is a compiled cache pattern: the request host followed by the
+// platform's fly-replay-cache path. The path is matched segment by segment:
+//
+//	literal   matches itself; \*, \{, \} and \\ escape special characters
+//	*         any run of characters within one segment, as in * or *.png
+//	**        zero or more whole segments
+//	{name}    exactly one non-empty segment, captured as name
+//
+// A * that makes up the last segment matches the rest of the path, like in
+// Fly's own fly-replay-cache patterns such as /users/123/*.
+type pathPattern struct {
+	host      string
+	segments  []patternSegment
+	prefix    string // literal text before the first wildcard, host included
+	suffix    string // literal text after the last wildcard
+	wildcards int    // number of *, ** and {name}
+}
+
+// segmentKind tells how a pattern segment matches
+type segmentKind int
+
+const (
+	segmentLiteral segmentKind = iota
+	segmentGlob                // contains *
+	segmentNamed               // {name}
+	segmentAny                 // **
+	segmentRest                // trailing *
+)
+
+// patternSegment is one /-separated part of a pattern's path
+type patternSegment struct {
+	kind  segmentKind
+	text  string   // literal text, or the name of a named segment
+	parts []string // literal text around the *s of a glob
+}
+
+// compilePattern parses a cache key such as "example.com/{locale}/user123/*"
+// and rejects anything that isn't a well-formed pattern
+func compilePattern(key string) (*pathPattern, error) {
+	if len(key) > maxPatternLength {
+		return nil, fmt.Errorf("pattern longer than %d bytes", maxPatternLength)
+	}
+	for _, c := range key {
+		if c < 0x20 || c == 0x7f || c == ' ' || c == '?' || c == '#' {
+			return nil, fmt.Errorf("pattern %q contains %q", key, c)
+		}
+	}
+
+	host, path, ok := splitHost(key)
+	if !ok {
+		return nil, fmt.Errorf("pattern %q has no path starting with /", key)
+	}
+	if strings.ContainsAny(host, `*{}\`) {
+		return nil, fmt.Errorf("pattern %q has wildcards in the host", key)
+	}
+
+	p := &pathPattern{host: host}
+	names := make(map[string]bool)
+	rawSegments := strings.Split(path[1:], "/")
+	for i, raw := range rawSegments {
+		last := i == len(rawSegments)-1
+		if raw == "" && !last {
+			return nil, fmt.Errorf("pattern %q has an empty segment", key)
+		}
+
+		seg, err := parseSegment(raw, last)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", key, err)
+		}
+		switch seg.kind {
+		case segmentGlob:
+			p.wildcards += len(seg.parts) - 1
+		case segmentNamed:
+			if names[seg.text] {
+				return nil, fmt.Errorf("pattern %q: duplicate segment name %q", key, seg.text)
+			}
+			names[seg.text] = true
+			p.wildcards++
+		case segmentAny, segmentRest:
+			p.wildcards++
+		}
+		p.segments = append(p.segments, seg)
+	}
+	if p.wildcards > maxPatternWildcards {
+		return nil, fmt.Errorf("pattern %q has more than %d wildcards", key, maxPatternWildcards)
+	}
+
+	p.prefix, p.suffix = p.literals()
+	return p, nil
+}
+
+// parseSegment parses one segment of a pattern's path
+func parseSegment(raw string, last bool) (patternSegment, error) {
+	switch {
+	case raw == "**":
+		return patternSegment{kind: segmentAny}, nil
+	case raw == "*" && last:
+		return patternSegment{kind: segmentRest}, nil
+	case strings.HasPrefix(raw, "{") && strings.HasSuffix(raw, "}"):
+		name := raw[1 : len(raw)-1]
+		if !validSegmentName(name) {
+			return patternSegment{}, fmt.Errorf("invalid segment name %q", name)
+		}
+		return patternSegment{kind: segmentNamed, text: name}, nil
+	}
+
+	var parts []string
+	var b strings.Builder
+	for i := 0; i < len(raw); i++ {
+		switch c := raw[i]; c {
+		case '\\':
+			i++
+			if i == len(raw) || !strings.ContainsRune(`*{}\`, rune(raw[i])) {
+				return patternSegment{}, fmt.Errorf("invalid escape in segment %q", raw)
+			}
+			b.WriteByte(raw[i])
+		case '*':
+			if i+1 < len(raw) && raw[i+1] == '*' {
+				return patternSegment{}, fmt.Errorf("** must be a whole segment, got %q", raw)
+			}
+			parts = append(parts, b.String())
+			b.Reset()
+		case '{', '}':
+			return patternSegment{}, fmt.Errorf("unescaped %q in segment %q", c, raw)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	if parts == nil {
+		return patternSegment{kind: segmentLiteral, text: b.String()}, nil
+	}
+	return patternSegment{kind: segmentGlob, parts: append(parts, b.String())}, nil
+}
+
+// literals returns the literal text before the first wildcard and after
+// the last one, used to index the pattern
+func (p *pathPattern) literals() (prefix, suffix string) {
+	first, last := -1, -1
+	for i, seg := range p.segments {
+		if seg.kind != segmentLiteral {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(p.host)
+	for i, seg := range p.segments {
+		if i == first {
+			break
+		}
+		b.WriteString("/" + seg.text)
+	}
+	if first < 0 {
+		return b.String(), ""
+	}
+
+	// Up to the first wildcard; ** may match nothing, slash included
+	switch seg := p.segments[first]; seg.kind {
+	case segmentAny:
+	case segmentGlob:
+		b.WriteString("/" + seg.parts[0])
+	default:
+		b.WriteString("/")
+	}
+	prefix = b.String()
+
+	b.Reset()
+	if seg := p.segments[last]; seg.kind == segmentGlob {
+		b.WriteString(seg.parts[len(seg.parts)-1])
+	}
+	for _, seg := range p.segments[last+1:] {
+		b.WriteString("/" + seg.text)
+	}
+	return prefix, b.String()
+}
+
+// matches reports whether fullPath, the request host and path, matches
+func (p *pathPattern) matches(fullPath string) bool {
+	return p.match(fullPath, nil)
+}
+
+// params returns the values of the named segments in fullPath
+func (p *pathPattern) params(fullPath string) map[string]string {
+	params := make(map[string]string)
+	if !p.match(fullPath, params) {
+		return nil
+	}
+	return params
+}
+
+// match matches fullPath, storing named segments in params when not nil
+func (p *pathPattern) match(fullPath string, params map[string]string) bool {
+	host, path, ok := splitHost(fullPath)
+	if !ok || host != p.host {
+		return false
+	}
+	return matchSegments(p.segments, strings.Split(path[1:], "/"), params)
+}
+
+// segmentMatch matches path segments against pattern segments,
+// backtracking over **. Positions that failed to match are remembered, so
+// patterns with several ** cost at most one attempt per pair of pattern
+// and path positions instead of trying every split of the path.
+type segmentMatch struct {
+	pattern  []patternSegment
+	segments []string
+	params   map[string]string
+	failed   []bool // by pattern index * (len(segments)+1) + segment index
+}
+
+// matchSegments reports whether segments match pattern, storing named
+// segments in params when not nil
+func matchSegments(pattern []patternSegment, segments []string, params map[string]string) bool {
+	m := segmentMatch{pattern: pattern, segments: segments, params: params}
+	return m.match(0, 0)
+}
+
+// match matches pattern[i:] against segments[j:]
+func (m *segmentMatch) match(i, j int) bool {
+	for ; i < len(m.pattern); i++ {
+		seg := m.pattern[i]
+		switch seg.kind {
+		case segmentRest:
+			// Needs the slash before it, i.e. at least an empty segment
+			return j < len(m.segments)
+		case segmentAny:
+			if m.failed == nil {
+				m.failed = make([]bool, (len(m.pattern)+1)*(len(m.segments)+1))
+			}
+			for skip := j; skip <= len(m.segments); skip++ {
+				pos := (i+1)*(len(m.segments)+1) + skip
+				if m.failed[pos] {
+					continue
+				}
+				if m.match(i+1, skip) {
+					return true
+				}
+				m.failed[pos] = true
+			}
+			return false
+		}
+
+		if j == len(m.segments) {
+			return false
+		}
+		switch seg.kind {
+		case segmentLiteral:
+			if m.segments[j] != seg.text {
+				return false
+			}
+		case segmentGlob:
+			if !matchGlob(seg.parts, m.segments[j]) {
+				return false
+			}
+		case segmentNamed:
+			if m.segments[j] == "" {
+				return false
+			}
+			if m.params != nil {
+				m.params[seg.text] = m.segments[j]
+			}
+		}
+		j++
+	}
+	return j == len(m.segments)
+}
+
+// matchGlob reports whether s is parts joined by any runs of characters
+func matchGlob(parts []string, s string) bool {
+	first, last := parts[0], parts[len(parts)-1]
+	if len(s) < len(first)+len(last) || !strings.HasPrefix(s, first) || !strings.HasSuffix(s, last) {
+		return false
+	}
+	s = s[len(first) : len(s)-len(last)]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return true
+}
+
+// validSegmentName reports whether s can name a {segment}
+func validSegmentName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,158 @@
+package flyreplay
+
+import (
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestCompilePattern(t *testing.T) {
+	tests := []struct {
+		pattern   string
+		prefix    string
+		suffix    string
+		wildcards int
+	}{
+		{"example.com/a/b", "example.com/a/b", "", 0},
+		{"example.com/", "example.com/", "", 0},
+		{"example.com/a/*", "example.com/a/", "", 1},
+		{"example.com/files/*/avatar.png", "example.com/files/", "/avatar.png", 1},
+		{"example.com/files/*.png", "example.com/files/", ".png", 1},
+		{"example.com/img/pre*mid*post", "example.com/img/pre", "post", 2},
+		{"example.com/a/**/c", "example.com/a", "/c", 1},
+		{"example.com/**", "example.com", "", 1},
+		{"example.com/{locale}/users/*", "example.com/", "", 2},
+		{"example.com/{locale}/users", "example.com/", "/users", 1},
+		{`example.com/a\*b`, "example.com/a*b", "", 0},
+		{`example.com/a\{b\}\\`, `example.com/a{b}\`, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			p, err := compilePattern(tt.pattern)
+			if err != nil {
+				t.Fatalf("compilePattern() error = %v", err)
+			}
+			if p.host != "example.com" {
+				t.Errorf("host = %q, want example.com", p.host)
+			}
+			if p.prefix != tt.prefix || p.suffix != tt.suffix {
+				t.Errorf("literals = %q, %q, want %q, %q", p.prefix, p.suffix, tt.prefix, tt.suffix)
+			}
+			if p.wildcards != tt.wildcards {
+				t.Errorf("wildcards = %d, want %d", p.wildcards, tt.wildcards)
+			}
+		})
+	}
+}
+
+func TestCompilePatternRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+	}{
+		{"no path", "example.com"},
+		{"empty segment", "example.com//a"},
+		{"wildcard in host", "*.example.com/a"},
+		{"space", "example.com/a b"},
+		{"query", "example.com/a?b"},
+		{"fragment", "example.com/a#b"},
+		{"control character", "example.com/a\tb"},
+		{"partial double star", "example.com/a**"},
+		{"unclosed brace", "example.com/{a"},
+		{"stray brace", "example.com/a}"},
+		{"empty name", "example.com/{}"},
+		{"invalid name", "example.com/{a-b}"},
+		{"duplicate name", "example.com/{a}/{a}"},
+		{"unknown escape", `example.com/a\x`},
+		{"trailing backslash", `example.com/a\`},
+		{"too many wildcards", "example.com" + strings.Repeat("/*", 9)},
+		{"too long", "example.com/" + strings.Repeat("a", maxPatternLength)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := compilePattern(tt.pattern); err == nil {
+				t.Errorf("compilePattern(%q) accepted an invalid pattern", tt.pattern)
+			}
+		})
+	}
+}
+
+func TestPatternMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"example.com/a/b", "example.com/a/b", true},
+		{"example.com/a/b", "example.com/a/b/", false},
+		{"example.com/a/b", "other.com/a/b", false},
+
+		// A trailing * matches the rest of the path, like Fly's patterns
+		{"example.com/a/*", "example.com/a/b", true},
+		{"example.com/a/*", "example.com/a/b/c", true},
+		{"example.com/a/*", "example.com/a/", true},
+		{"example.com/a/*", "example.com/a", false},
+
+		// Elsewhere * stays within one segment
+		{"example.com/a/*/c", "example.com/a/b/c", true},
+		{"example.com/a/*/c", "example.com/a/b/x/c", false},
+		{"example.com/files/*.png", "example.com/files/a.png", true},
+		{"example.com/files/*.png", "example.com/files/a.jpg", false},
+		{"example.com/files/*.png", "example.com/files/x/a.png", false},
+		{"example.com/a*b*c", "example.com/abc", true},
+		{"example.com/a*b*c", "example.com/aXbYc", true},
+		{"example.com/a*b*c", "example.com/aXcYb", false},
+
+		{"example.com/a/**/c", "example.com/a/c", true},
+		{"example.com/a/**/c", "example.com/a/b/x/c", true},
+		{"example.com/a/**/c", "example.com/a/b/x/d", false},
+		{"example.com/a/**", "example.com/a", true},
+		{"example.com/**", "example.com/", true},
+
+		{"example.com/{locale}/users", "example.com/en/users", true},
+		{"example.com/{locale}/users", "example.com//users", false},
+		{"example.com/{locale}/users", "example.com/en/fr/users", false},
+
+		{`example.com/a\*b`, "example.com/a*b", true},
+		{`example.com/a\*b`, "example.com/axb", false},
+	}
+	for _, tt := range tests {
+		p, err := compilePattern(tt.pattern)
+		if err != nil {
+			t.Fatalf("compilePattern(%q) error = %v", tt.pattern, err)
+		}
+		if got := p.matches(tt.path); got != tt.want {
+			t.Errorf("%q matches %q = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPatternParams(t *testing.T) {
+	p, err := compilePattern("example.com/{locale}/**/{user}/profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"locale": "en-US", "user": "user123"}
+	if got := p.params("example.com/en-US/x/y/user123/profile"); !maps.Equal(got, want) {
+		t.Errorf("params() = %v, want %v", got, want)
+	}
+	if got := p.params("example.com/en-US"); got != nil {
+		t.Errorf("params() of a path that doesn't match = %v, want nil", got)
+	}
+}
+
+func TestPatternManyDoubleStars(t *testing.T) {
+	// Without memoization this takes O(n^k) for k ** and n segments
+	p, err := compilePattern("example.com/**/a/**/a/**/a/**/a/**/a/**/a/**/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "example.com" + strings.Repeat("/a", 500)
+	if p.matches(path) {
+		t.Errorf("matched a path without b")
+	}
+	if !p.matches(path + "/b") {
+		t.Errorf("didn't match a path ending in b")
+	}
+}
@@ -0,0 +1,265 @@
+package flyreplay
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheFileName names the snapshot file written inside cache_dir by the
+// handler with the given id, so handlers sharing a cache_dir keep apart
+func cacheFileName(id string) string {
+	if id == "" {
+		return "fly-replay-cache.json"
+	}
+	return "fly-replay-cache-" + id + ".json"
+}
+
+// snapshotOwners tracks the handler writing each snapshot file. Handlers of
+// one config may not share a file; on reload, a handler of the new config
+// takes over the file of the one it replaces.
+var snapshotOwners struct {
+	sync.Mutex
+	files map[string]snapshotOwner
+}
+
+// snapshotOwner is a handler and the config it was provisioned for
+type snapshotOwner struct {
+	handler *FlyReplay
+	config  context.Context
+}
+
+// claimSnapshot makes f, provisioned for config, the writer of file
+func claimSnapshot(f *FlyReplay, config context.Context, file string) error {
+	snapshotOwners.Lock()
+	defer snapshotOwners.Unlock()
+
+	if owner, ok := snapshotOwners.files[file]; ok && owner.handler != f && owner.config == config {
+		return fmt.Errorf("cache snapshot %s is written by another fly_replay handler; give each handler its own id or cache_dir", file)
+	}
+	if snapshotOwners.files == nil {
+		snapshotOwners.files = make(map[string]snapshotOwner)
+	}
+	snapshotOwners.files[file] = snapshotOwner{handler: f, config: config}
+	return nil
+}
+
+// releaseSnapshot gives up f's claim on file, unless a newer handler took
+// it over
+func releaseSnapshot(f *FlyReplay, file string) {
+	snapshotOwners.Lock()
+	defer snapshotOwners.Unlock()
+
+	if snapshotOwners.files[file].handler == f {
+		delete(snapshotOwners.files, file)
+	}
+}
+
+// cacheFileVersion is bumped whenever the snapshot layout changes.
+// Snapshots written with a different version are discarded on load.
+const cacheFileVersion = 1
+
+// cacheSnapshot is the on-disk representation of a PathCache
+type cacheSnapshot struct {
+	Version int             `json:"version"`
+	SavedAt time.Time       `json:"saved_at"`
+	Entries []snapshotEntry `json:"entries"`
+}
+
+// snapshotEntry is the on-disk representation of a CacheEntry. Entries
+// are written in the order they were stored.
+type snapshotEntry struct {
+	Path        string            `json:"path"`
+	Pattern     string            `json:"pattern"`
+	Target      string            `json:"target"`
+	Instance    string            `json:"instance,omitempty"`
+	AllowBypass bool              `json:"allow_bypass,omitempty"`
+	Response    *snapshotResponse `json:"response,omitempty"`
+	Vary        []string          `json:"vary,omitempty"`
+	Variant     string            `json:"variant,omitempty"`
+	ExpiresAt   time.Time         `json:"expires_at"`
+}
+
+// snapshotResponse is the on-disk representation of a CachedResponse
+type snapshotResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+}
+
+// Load reads a snapshot from file and restores its unexpired entries.
+// A missing file or a snapshot from another format version is not an error.
+func (c *PathCache) Load(file string) (int, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("reading cache snapshot: %w", err)
+	}
+
+	var snap cacheSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return 0, fmt.Errorf("decoding cache snapshot %s: %w", file, err)
+	}
+	if snap.Version != cacheFileVersion {
+		// Routing decisions are cheap to relearn, so just start over
+		return 0, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	loaded := 0
+	for _, e := range snap.Entries {
+		if e.Pattern == "" || !now.Before(e.ExpiresAt) {
+			continue
+		}
+		matcher, err := compilePattern(e.Pattern)
+		if err != nil {
+			// Written by an older, laxer version; relearn it
+			continue
+		}
+		if vary, err := parseVary(strings.Join(e.Vary, ",")); err != nil || !slices.Equal(vary, e.Vary) {
+			continue
+		}
+		entry := &CacheEntry{
+			Path:        e.Path,
+			Target:      e.Target,
+			Instance:    e.Instance,
+			Pattern:     e.Pattern,
+			AllowBypass: e.AllowBypass,
+			Vary:        e.Vary,
+			Variant:     e.Variant,
+			ExpiresAt:   e.ExpiresAt,
+			matcher:     matcher,
+		}
+		if resp := e.Response; resp != nil {
+			entry.Response = &CachedResponse{StatusCode: resp.StatusCode, Header: resp.Header, Body: resp.Body}
+		}
+		c.put(entry)
+		loaded++
+	}
+
+	// Nothing to write back until something changes
+	c.dirty.Store(false)
+	return loaded, nil
+}
+
+// Save atomically writes the unexpired entries to file. The snapshot is
+// written to a temporary file in the same directory, synced and renamed
+// over the previous snapshot, so a crash never leaves a partial file.
+func (c *PathCache) Save(file string) error {
+	// Serialize writers so an older snapshot never replaces a newer one
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+
+	// Changes made while writing mark the cache dirty again
+	c.dirty.Store(false)
+	if err := c.save(file); err != nil {
+		c.dirty.Store(true)
+		return err
+	}
+	return nil
+}
+
+// Dirty reports whether the cache changed since it was last saved or
+// loaded
+func (c *PathCache) Dirty() bool {
+	return c.dirty.Load()
+}
+
+// save writes the snapshot; the caller holds saveMu
+func (c *PathCache) save(file string) error {
+	snap := cacheSnapshot{
+		Version: cacheFileVersion,
+		SavedAt: time.Now(),
+		Entries: c.snapshot(),
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding cache snapshot: %w", err)
+	}
+
+	dir := filepath.Dir(file)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating cache snapshot: %w", err)
+	}
+	tmpName := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("writing cache snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("syncing cache snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("closing cache snapshot: %w", err)
+	}
+	if err := os.Rename(tmpName, file); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("replacing cache snapshot: %w", err)
+	}
+
+	// Persist the rename itself; not every platform supports syncing a
+	// directory, so failures here are ignored
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// snapshot copies the unexpired entries under the read lock
+func (c *PathCache) snapshot() []snapshotEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	// Oldest first, so loading the snapshot restores the store order
+	stored := make([]*CacheEntry, 0, len(c.store))
+	for _, entry := range c.store {
+		stored = append(stored, entry)
+	}
+	slices.SortFunc(stored, func(a, b *CacheEntry) int { return cmp.Compare(a.seq, b.seq) })
+
+	now := time.Now()
+	entries := make([]snapshotEntry, 0, len(stored))
+	for _, entry := range stored {
+		if !now.Before(entry.ExpiresAt) {
+			continue
+		}
+		e := snapshotEntry{
+			Path:        entry.Path,
+			Pattern:     entry.Pattern,
+			Target:      entry.Target,
+			Instance:    entry.Instance,
+			AllowBypass: entry.AllowBypass,
+			Vary:        entry.Vary,
+			Variant:     entry.Variant,
+			ExpiresAt:   entry.ExpiresAt,
+		}
+		if resp := entry.Response; resp != nil {
+			e.Response = &snapshotResponse{StatusCode: resp.StatusCode, Header: resp.Header, Body: resp.Body}
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
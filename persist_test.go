@@ -0,0 +1,162 @@
+package flyreplay
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// writeSnapshot writes snap to a file in a temporary directory
+func writeSnapshot(t *testing.T, snap cacheSnapshot) string {
+	t.Helper()
+	data, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), cacheFileName(""))
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestPathCacheSaveLoad(t *testing.T) {
+	cache := NewPathCache()
+	if err := cache.Set("example.com/a/b", "example.com/a/*", "app-a", "i1", 60, true); err != nil {
+		t.Fatal(err)
+	}
+	resp := &CachedResponse{StatusCode: 404, Header: http.Header{"X-Reason": {"unknown"}}, Body: []byte("no such tenant")}
+	if err := cache.SetResponse("example.com/n", "example.com/n", nil, nil, resp, 60, false); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Tenant", "t1")
+	if err := cache.SetVariant("example.com/v", "example.com/v/*", []string{"X-Tenant"}, r, "app-t1", "", 60, false); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), cacheFileName(""))
+	if err := cache.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	if cache.Dirty() {
+		t.Errorf("cache dirty after Save()")
+	}
+
+	loaded := NewPathCache()
+	if n, err := loaded.Load(file); err != nil || n != 3 {
+		t.Fatalf("Load() = %d, %v, want 3 entries", n, err)
+	}
+	if loaded.Dirty() {
+		t.Errorf("cache dirty after Load()")
+	}
+
+	if entry, ok := loaded.Get("example.com/a/c", nil); !ok || entry.Target != "app-a" || entry.Instance != "i1" || !entry.AllowBypass {
+		t.Errorf("Get(example.com/a/c) = %+v, %v, want app-a/i1 with bypass", entry, ok)
+	}
+	if entry, ok := loaded.Get("example.com/n", nil); !ok || entry.Response == nil ||
+		entry.Response.StatusCode != 404 || string(entry.Response.Body) != "no such tenant" || entry.Response.Header.Get("X-Reason") != "unknown" {
+		t.Errorf("Get(example.com/n) = %+v, %v, want the negative entry", entry, ok)
+	}
+	if entry, ok := loaded.Get("example.com/v/x", r); !ok || entry.Target != "app-t1" {
+		t.Errorf("Get(example.com/v/x) for t1 = %+v, %v, want app-t1", entry, ok)
+	}
+	other := httptest.NewRequest("GET", "/", nil)
+	other.Header.Set("X-Tenant", "t2")
+	if entry, ok := loaded.Get("example.com/v/x", other); ok {
+		t.Errorf("Get(example.com/v/x) for t2 = %+v, want a miss", entry)
+	}
+}
+
+func TestPathCacheLoadSkipsExpired(t *testing.T) {
+	now := time.Now()
+	file := writeSnapshot(t, cacheSnapshot{Version: cacheFileVersion, Entries: []snapshotEntry{
+		{Path: "example.com/old", Pattern: "example.com/old", Target: "app", ExpiresAt: now.Add(-time.Second)},
+		{Path: "example.com/new", Pattern: "example.com/new", Target: "app", ExpiresAt: now.Add(time.Minute)},
+	}})
+
+	cache := NewPathCache()
+	if n, err := cache.Load(file); err != nil || n != 1 {
+		t.Fatalf("Load() = %d, %v, want 1 entry", n, err)
+	}
+	if _, ok := cache.Get("example.com/old", nil); ok {
+		t.Errorf("expired entry restored")
+	}
+	if _, ok := cache.Get("example.com/new", nil); !ok {
+		t.Errorf("unexpired entry not restored")
+	}
+}
+
+func TestPathCacheLoadDiscardsOtherVersion(t *testing.T) {
+	file := writeSnapshot(t, cacheSnapshot{Version: cacheFileVersion + 1, Entries: []snapshotEntry{
+		{Path: "example.com/a", Pattern: "example.com/a", Target: "app", ExpiresAt: time.Now().Add(time.Minute)},
+	}})
+
+	cache := NewPathCache()
+	if n, err := cache.Load(file); err != nil || n != 0 {
+		t.Errorf("Load() = %d, %v, want nothing restored", n, err)
+	}
+	if cache.Len() != 0 {
+		t.Errorf("cache holds %d entries, want none", cache.Len())
+	}
+}
+
+func TestPathCacheLoadCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, cacheFileName(""))
+	if err := os.WriteFile(file, []byte(`{"version": 1, "entries": [`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPathCache().Load(file); err == nil {
+		t.Errorf("Load() of a truncated snapshot succeeded")
+	}
+
+	// Provisioning discards it rather than failing
+	provision(t, &FlyReplay{EnableCache: true, CacheDir: dir})
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("corrupt snapshot kept, Stat() error = %v", err)
+	}
+}
+
+func TestProvisionSnapshotFiles(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// Handlers of one config need a snapshot file each
+	handlers := []*FlyReplay{
+		{EnableCache: true, CacheDir: dir},
+		{EnableCache: true, CacheDir: dir, ID: "a"},
+		{EnableCache: true, CacheDir: dir, ID: "b"},
+	}
+	for _, f := range handlers {
+		if err := f.Provision(ctx); err != nil {
+			t.Fatalf("Provision(%q) error = %v", f.ID, err)
+		}
+		defer f.Cleanup()
+	}
+	if got, want := filepath.Base(handlers[1].cacheFile), "fly-replay-cache-a.json"; got != want {
+		t.Errorf("snapshot file = %s, want %s", got, want)
+	}
+	dup := &FlyReplay{EnableCache: true, CacheDir: dir, ID: "a"}
+	if err := dup.Provision(ctx); err == nil {
+		t.Errorf("Provision() of a second handler with id a succeeded")
+	}
+	dup.Cleanup()
+
+	// A handler of the next config takes over the file
+	next, cancelNext := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancelNext()
+	reloaded := &FlyReplay{EnableCache: true, CacheDir: dir, ID: "a"}
+	if err := reloaded.Provision(next); err != nil {
+		t.Fatalf("Provision() after reload error = %v", err)
+	}
+	defer reloaded.Cleanup()
+}
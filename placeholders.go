@@ -0,0 +1,32 @@
+package flyreplay
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Routing outcomes exposed as {http.fly_replay.*} placeholders and as
+// fly_replay_* fields in the access log
+const (
+	routeApp          = "app"           // app that served the request
+	routeInstance     = "instance"      // instance that served the request, if named
+	routeCacheStatus  = "cache_status"  // hit, miss or bypass; unset without enable_cache
+	routeCachePattern = "cache_pattern" // cache entry that matched or was stored
+	routeCacheMatch   = "cache_match"   // exact or wildcard, for the entry that matched
+	routeHops         = "hops"          // hop chain, e.g. "platform -> user123-app"
+	routeParam        = "param."        // prefix of {name} segments captured by the cache entry
+)
+
+// setRouteInfo records one routing outcome of r for placeholders and the
+// access log. Later calls overwrite earlier ones, so the last hop wins.
+func setRouteInfo(r *http.Request, key, value string) {
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Set("http.fly_replay."+key, value)
+	}
+	if extra, ok := r.Context().Value(caddyhttp.ExtraLogFieldsCtxKey).(*caddyhttp.ExtraLogFields); ok {
+		extra.Set(zap.String("fly_replay_"+key, value))
+	}
+}
@@ -1,12 +1,23 @@
 package flyreplay
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 	
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/dustin/go-humanize"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 func init() {
@@ -24,25 +35,184 @@ func (FlyReplay) CaddyModule() caddy.ModuleInfo {
 
 // Provision implements caddy.Provisioner.
 func (f *FlyReplay) Provision(ctx caddy.Context) error {
+	// Routing decisions are logged at debug level, and only in debug mode
+	f.logger = ctx.Logger()
+	if !f.Debug {
+		f.logger = f.logger.WithOptions(zap.IncreaseLevel(zapcore.InfoLevel))
+	}
+
 	if f.Apps == nil {
 		f.Apps = make(map[string]AppConfig)
 	}
+
+	// Regions are matched case-insensitively, like in fly-replay
+	f.Region = strings.ToLower(f.Region)
+	if f.Region == "" {
+		f.Region = defaultRegion
+	}
+	regionLatency := make(map[string]caddy.Duration, len(f.RegionLatency))
+	for region, latency := range f.RegionLatency {
+		regionLatency[strings.ToLower(region)] = latency
+	}
+	f.RegionLatency = regionLatency
+
+	// Give each app its own pooled transport, shared by all requests
+	for name, app := range f.Apps {
+		if err := app.provision(ctx, f.Region); err != nil {
+			return fmt.Errorf("app %s: %w", name, err)
+		}
+		f.Apps[name] = app
+	}
 	
+	// Register collectors on Caddy's metrics endpoint
+	registry := ctx.GetMetricsRegistry()
+	if registry == nil {
+		registry = prometheus.NewRegistry()
+	}
+	metrics, err := newReplayMetrics(registry)
+	if err != nil {
+		return fmt.Errorf("registering metrics: %w", err)
+	}
+	f.metrics = metrics
+
+	// Request bodies spill to cache_dir even without a route cache
+	if f.CacheDir != "" {
+		if err := os.MkdirAll(f.CacheDir, 0o755); err != nil {
+			return fmt.Errorf("creating cache_dir: %w", err)
+		}
+	}
+
 	// Initialize cache if enabled
 	if f.EnableCache {
 		f.cache = NewPathCache()
+		if f.Eviction == "" {
+			f.Eviction = EvictLRU
+		}
+		f.cache.SetLimits(f.MaxEntries, f.MaxMemory, f.Eviction, f.cacheEvicted)
+		f.metrics.cacheEntries.add(f.cache)
+		registerHandler(f)
+
+		// Restore routing decisions learned before the last reload/restart
+		if f.CacheDir != "" {
+			// The id names the snapshot file, so it can't hold a path
+			if strings.ContainsAny(f.ID, `/\`) {
+				return fmt.Errorf("id must not contain path separators, got %q", f.ID)
+			}
+			file, err := filepath.Abs(filepath.Join(f.CacheDir, cacheFileName(f.ID)))
+			if err != nil {
+				return fmt.Errorf("resolving cache_dir: %w", err)
+			}
+			if err := claimSnapshot(f, ctx.Context, file); err != nil {
+				return err
+			}
+			f.cacheFile = file
+			loaded, err := f.cache.Load(f.cacheFile)
+			if err != nil {
+				// Like a snapshot from another version, a damaged one is
+				// only worth relearning, not failing the config over
+				f.logger.Warn("discarding unreadable route cache snapshot",
+					zap.String("file", f.cacheFile),
+					zap.Error(err))
+				os.Remove(f.cacheFile)
+			} else {
+				f.logger.Info("restored route cache",
+					zap.String("file", f.cacheFile),
+					zap.Int("entries", loaded))
+			}
+		}
+
+		// Sweep expired entries in the background rather than on requests
+		if f.CleanupInterval == 0 {
+			f.CleanupInterval = caddy.Duration(defaultCleanupInterval)
+		}
+		f.janitor = make(chan struct{})
+		go f.runJanitor(time.Duration(f.CleanupInterval), f.janitor)
+
+		// Collapse concurrent misses for a path into one platform call
+		if f.CoalesceTimeout == 0 {
+			f.CoalesceTimeout = caddy.Duration(defaultCoalesceTimeout)
+		}
+		if f.CoalesceTimeout > 0 {
+			f.flights = newFlightGroup()
+		}
 	}
 	
 	// Set default cache TTL if not specified
 	if f.CacheTTL == 0 {
 		f.CacheTTL = 300 // 5 minutes default
 	}
+
+	// Set default in-memory body buffer if not specified
+	if f.MemoryBufferSize == 0 {
+		f.MemoryBufferSize = defaultMemoryBufferSize
+	}
+
+	// Set default negative cache body limit if not specified
+	if f.NegativeCacheMaxBody == 0 {
+		f.NegativeCacheMaxBody = defaultNegativeCacheMaxBody
+	}
+
+	// Set default replay depth if not specified; a limit of 0 would refuse
+	// even the platform's replay, so 0 means unset
+	if f.MaxReplays == 0 {
+		f.MaxReplays = 5
+	}
 	
 	return nil
 }
 
+// Cleanup implements caddy.CleanerUpper.
+func (f *FlyReplay) Cleanup() error {
+	for _, app := range f.Apps {
+		app.cleanup()
+	}
+
+	if f.janitor != nil {
+		close(f.janitor)
+	}
+	if f.cache != nil && f.metrics != nil {
+		f.metrics.cacheEntries.remove(f.cache)
+	}
+	unregisterHandler(f)
+
+	// Flush the final state so the next config picks it up
+	if f.cache != nil && f.cacheFile != "" {
+		releaseSnapshot(f, f.cacheFile)
+		return f.cache.Save(f.cacheFile)
+	}
+	return nil
+}
+
 // Validate implements caddy.Validator.
 func (f *FlyReplay) Validate() error {
+	if f.MaxReplays < 0 {
+		return fmt.Errorf("max_replays must not be negative")
+	}
+	if f.MaxBufferSize < 0 || f.MemoryBufferSize < 0 {
+		return fmt.Errorf("buffer sizes must not be negative")
+	}
+	if f.MaxEntries < 0 || f.MaxMemory < 0 {
+		return fmt.Errorf("cache limits must not be negative")
+	}
+	switch f.Eviction {
+	case "", EvictLRU, EvictLFU:
+	default:
+		return fmt.Errorf("eviction must be %s or %s, got %q", EvictLRU, EvictLFU, f.Eviction)
+	}
+	if f.CleanupInterval < 0 {
+		return fmt.Errorf("cleanup_interval must not be negative")
+	}
+	if f.NegativeCache && !f.EnableCache {
+		return fmt.Errorf("negative_cache requires enable_cache")
+	}
+	if f.NegativeCacheMaxBody < 0 {
+		return fmt.Errorf("negative_cache_max_body must not be negative")
+	}
+	for region, latency := range f.RegionLatency {
+		if latency < 0 {
+			return fmt.Errorf("region_latency for %s must not be negative", region)
+		}
+	}
 	return nil
 }
 
@@ -60,6 +230,12 @@ func (f *FlyReplay) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
 		for d.NextBlock(0) {
 			switch d.Val() {
+			case "id":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				f.ID = d.Val()
+				
 			case "enable_cache":
 				if !d.NextArg() {
 					return d.ArgErr()
@@ -82,6 +258,133 @@ func (f *FlyReplay) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				}
 				f.CacheTTL = ttl
 				
+			case "max_replays":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				maxReplays, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return err
+				}
+				// The platform's replay counts, so 0 would refuse every one
+				if maxReplays < 1 {
+					return d.Errf("max_replays must be at least 1, got %d", maxReplays)
+				}
+				f.MaxReplays = maxReplays
+				
+			case "max_entries":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				maxEntries, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("bad max_entries value '%s': %v", d.Val(), err)
+				}
+				f.MaxEntries = maxEntries
+				
+			case "max_memory":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("bad max_memory value '%s': %v", d.Val(), err)
+				}
+				f.MaxMemory = int64(size)
+				
+			case "eviction":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				f.Eviction = d.Val()
+				
+			case "cleanup_interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				interval, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("bad cleanup_interval value '%s': %v", d.Val(), err)
+				}
+				f.CleanupInterval = caddy.Duration(interval)
+				
+			case "negative_cache":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				f.NegativeCache = d.Val() == "true"
+				
+			case "negative_cache_max_body":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("bad negative_cache_max_body value '%s': %v", d.Val(), err)
+				}
+				f.NegativeCacheMaxBody = int64(size)
+				
+			case "coalesce_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if d.Val() == "off" {
+					f.CoalesceTimeout = -1
+				} else {
+					timeout, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("bad coalesce_timeout value '%s': %v", d.Val(), err)
+					}
+					f.CoalesceTimeout = caddy.Duration(timeout)
+				}
+				
+			case "ask_platform_headers_only":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				f.AskPlatformHeadersOnly = d.Val() == "true"
+				
+			case "max_buffer_size", "memory_buffer_size":
+				prop := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("bad %s value '%s': %v", prop, d.Val(), err)
+				}
+				if prop == "max_buffer_size" {
+					f.MaxBufferSize = int64(size)
+				} else {
+					f.MemoryBufferSize = int64(size)
+				}
+				
+			case "region":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				f.Region = d.Val()
+				
+			case "region_latency":
+				var region, value string
+				if !d.Args(&region, &value) {
+					return d.ArgErr()
+				}
+				latency, err := caddy.ParseDuration(value)
+				if err != nil {
+					return d.Errf("bad region_latency value '%s': %v", value, err)
+				}
+				if f.RegionLatency == nil {
+					f.RegionLatency = make(map[string]caddy.Duration)
+				}
+				f.RegionLatency[region] = caddy.Duration(latency)
+				
+			case "metrics_per_host":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				f.MetricsPerHost = d.Val() == "true"
+				
 			case "debug":
 				if !d.NextArg() {
 					return d.ArgErr()
@@ -100,13 +403,93 @@ func (f *FlyReplay) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 								return d.ArgErr()
 							}
 							app.Domain = d.Val()
+						case "keepalive":
+							if !d.NextArg() {
+								return d.ArgErr()
+							}
+							if d.Val() == "off" {
+								app.KeepAlive = -1
+							} else {
+								dur, err := caddy.ParseDuration(d.Val())
+								if err != nil {
+									return d.Errf("bad keepalive value '%s': %v", d.Val(), err)
+								}
+								app.KeepAlive = caddy.Duration(dur)
+							}
+						case "max_idle_conns", "max_idle_conns_per_host":
+							prop := d.Val()
+							if !d.NextArg() {
+								return d.ArgErr()
+							}
+							num, err := strconv.Atoi(d.Val())
+							if err != nil {
+								return d.Errf("bad %s value '%s': %v", prop, d.Val(), err)
+							}
+							if prop == "max_idle_conns" {
+								app.MaxIdleConns = num
+							} else {
+								app.MaxIdleConnsPerHost = num
+							}
+						case "idle_conn_timeout", "dial_timeout", "response_header_timeout":
+							prop := d.Val()
+							if !d.NextArg() {
+								return d.ArgErr()
+							}
+							dur, err := caddy.ParseDuration(d.Val())
+							if err != nil {
+								return d.Errf("bad %s value '%s': %v", prop, d.Val(), err)
+							}
+							switch prop {
+							case "idle_conn_timeout":
+								app.IdleConnTimeout = caddy.Duration(dur)
+							case "dial_timeout":
+								app.DialTimeout = caddy.Duration(dur)
+							case "response_header_timeout":
+								app.ResponseHeaderTimeout = caddy.Duration(dur)
+							}
+						case "region":
+							if !d.NextArg() {
+								return d.ArgErr()
+							}
+							app.Region = d.Val()
+						case "instance":
+							args := d.RemainingArgs()
+							if len(args) < 2 || len(args) > 3 {
+								return d.ArgErr()
+							}
+							inst := InstanceConfig{Address: args[1]}
+							if len(args) == 3 {
+								inst.Region = args[2]
+							}
+							if app.Instances == nil {
+								app.Instances = make(map[string]InstanceConfig)
+							}
+							if _, exists := app.Instances[args[0]]; exists {
+								return d.Errf("app %s: duplicate instance %s", appName, args[0])
+							}
+							app.Instances[args[0]] = inst
+						case "reverse_proxy":
+							var rp reverseproxy.Handler
+							if err := rp.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+								return err
+							}
+							app.ReverseProxyRaw = caddyconfig.JSONModuleObject(&rp, "handler", "reverse_proxy", nil)
 						default:
 							return d.Errf("unknown app property: %s", d.Val())
 						}
 					}
 					
-					if app.Domain == "" {
-						return d.Errf("app %s must have a domain", appName)
+					targets := 0
+					for _, set := range []bool{app.Domain != "", len(app.Instances) > 0, app.ReverseProxyRaw != nil} {
+						if set {
+							targets++
+						}
+					}
+					if targets == 0 {
+						return d.Errf("app %s must have a domain, instances or reverse_proxy", appName)
+					}
+					if targets > 1 {
+						return d.Errf("app %s: domain, instance and reverse_proxy are mutually exclusive", appName)
 					}
 					
 					f.Apps[appName] = app
@@ -0,0 +1,249 @@
+package flyreplay
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+)
+
+// ResponseRecorder sits between an upstream (the platform or an app) and
+// the client. It decides when the upstream writes its header: responses
+// carrying a replay directive are held back so the replay can be followed,
+// everything else streams straight through to the client.
+type ResponseRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	body        *bytes.Buffer
+	header      http.Header
+	wroteHeader bool
+	replay      bool // response is a replay directive, held back
+
+	// Copy of a passed through response marked with fly-replay-cache, for
+	// the negative cache
+	captureLimit int64
+	captured     *bytes.Buffer
+	overflowed   bool // the body outgrew captureLimit, or the connection was hijacked
+
+	onPassThrough func() // called once the response is known to stream through uncaptured
+}
+
+// NewResponseRecorder creates a new ResponseRecorder
+func NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
+	return &ResponseRecorder{
+		ResponseWriter: w,
+		body:           new(bytes.Buffer),
+		header:         make(http.Header),
+		statusCode:     http.StatusOK,
+	}
+}
+
+// Header returns the upstream's header map, kept apart from the client's
+// until we know the response is passed through. From then on it is the
+// client's, so trailers set after the body (e.g. grpc-status) reach it.
+func (r *ResponseRecorder) Header() http.Header {
+	if r.wroteHeader && !r.replay {
+		return r.ResponseWriter.Header()
+	}
+	return r.header
+}
+
+// WriteHeader decides whether the response is a replay or passed through
+func (r *ResponseRecorder) WriteHeader(code int) {
+	if r.wroteHeader {
+		return
+	}
+
+	// Informational responses like 103 Early Hints don't decide anything
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		r.copyHeader()
+		r.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	r.wroteHeader = true
+	r.statusCode = code
+
+	if isReplayResponse(r.header) {
+		r.replay = true
+		return
+	}
+
+	if r.captureLimit > 0 && r.header.Get("fly-replay-cache") != "" {
+		r.captured = new(bytes.Buffer)
+	} else {
+		r.passThrough()
+	}
+
+	r.copyHeader()
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Write passes the body through, or keeps it when it is a replay body
+func (r *ResponseRecorder) Write(p []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.replay {
+		return r.bufferReplay(p)
+	}
+	n, err := r.ResponseWriter.Write(p)
+	if r.captured != nil {
+		r.capture(p[:n])
+	}
+	return n, err
+}
+
+// ReadFrom implements io.ReaderFrom so passed through bodies can use the
+// client connection's fast path
+func (r *ResponseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.replay {
+		return io.Copy(writerFunc(r.bufferReplay), src)
+	}
+	if r.captured != nil {
+		return io.Copy(writerFunc(r.Write), src)
+	}
+	return io.Copy(r.ResponseWriter, src)
+}
+
+// Flush implements http.Flusher for streamed responses such as SSE
+func (r *ResponseRecorder) Flush() {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.replay {
+		http.NewResponseController(r.ResponseWriter).Flush()
+	}
+}
+
+// Hijack implements http.Hijacker for upgraded connections
+func (r *ResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if r.replay {
+		return nil, nil, http.ErrNotSupported
+	}
+	// Whatever happens on the raw connection is not a replay, nor cacheable
+	r.wroteHeader = true
+	r.overflowed = true
+	r.passThrough()
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the client's writer
+func (r *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Replayed reports whether the response was held back as a replay
+func (r *ResponseRecorder) Replayed() bool {
+	return r.replay
+}
+
+// ReplayDirective returns the replay instruction in the recorded response,
+// either from the fly-replay header or from a JSON replay body. It returns
+// nil when the upstream answered the request itself.
+func (r *ResponseRecorder) ReplayDirective() (*ReplayDirective, error) {
+	if !r.replay {
+		return nil, nil
+	}
+	return parseReplayResponse(r.header, func() ([]byte, error) {
+		return r.body.Bytes(), nil
+	})
+}
+
+// OnPassThrough registers fn to be called as soon as the response is known
+// to be neither a replay nor captured for the negative cache, i.e. it
+// decides nothing beyond itself
+func (r *ResponseRecorder) OnPassThrough(fn func()) {
+	r.onPassThrough = fn
+}
+
+// passThrough calls the OnPassThrough function, once
+func (r *ResponseRecorder) passThrough() {
+	if fn := r.onPassThrough; fn != nil {
+		r.onPassThrough = nil
+		fn()
+	}
+}
+
+// defaultNegativeCacheMaxBody is the largest platform response body the
+// negative cache keeps when negative_cache_max_body isn't set
+const defaultNegativeCacheMaxBody = 64 << 10
+
+// CaptureBody keeps a copy of a passed through response that carries a
+// fly-replay-cache header, as long as its body fits in limit bytes
+func (r *ResponseRecorder) CaptureBody(limit int64) {
+	r.captureLimit = limit
+}
+
+// CapturedResponse returns the copy of the passed through response, or nil
+// when none was captured or it didn't fit
+func (r *ResponseRecorder) CapturedResponse() *CachedResponse {
+	if r.captured == nil || r.overflowed {
+		return nil
+	}
+	header := r.header.Clone()
+	for _, key := range cacheHeaders {
+		header.Del(key)
+	}
+	// The server dates each response it serves from the cache
+	header.Del("Date")
+	return &CachedResponse{
+		StatusCode: r.statusCode,
+		Header:     header,
+		Body:       bytes.Clone(r.captured.Bytes()),
+	}
+}
+
+// cacheHeaders are the headers, in canonical form, a platform response
+// addresses to the proxy when it asks for a negative cache entry; the
+// client never sees them
+var cacheHeaders = []string{
+	"Fly-Replay-Cache",
+	"Fly-Replay-Cache-Ttl-Secs",
+	"Fly-Replay-Cache-Allow-Bypass",
+	"Fly-Replay-Cache-Vary",
+}
+
+// capture appends p to the copy of a passed through body
+func (r *ResponseRecorder) capture(p []byte) {
+	if r.overflowed {
+		return
+	}
+	if int64(r.captured.Len()+len(p)) > r.captureLimit {
+		r.overflowed = true
+		r.captured.Reset()
+		return
+	}
+	r.captured.Write(p)
+}
+
+// copyHeader copies the upstream's headers to the client's response
+func (r *ResponseRecorder) copyHeader() {
+	for key, values := range r.header {
+		if r.captured != nil && slices.Contains(cacheHeaders, key) {
+			continue
+		}
+		for _, value := range values {
+			r.ResponseWriter.Header().Add(key, value)
+		}
+	}
+}
+
+// bufferReplay keeps the start of a replay body; only that much of a JSON
+// replay body is ever parsed
+func (r *ResponseRecorder) bufferReplay(p []byte) (int, error) {
+	if room := maxReplayBodySize - r.body.Len(); room > 0 {
+		r.body.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+// writerFunc adapts a function to io.Writer
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
@@ -0,0 +1,75 @@
+package flyreplay
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// defaultRegion is the local region when none is configured
+const defaultRegion = "local"
+
+// anyRegion in a region= list accepts an instance in any region
+const anyRegion = "any"
+
+// setEdgeHeaders adds the headers Fly's edge puts on every request it
+// proxies, replacing whatever the client sent
+func (f *FlyReplay) setEdgeHeaders(r *http.Request) {
+	r.Header.Set("Fly-Region", f.Region)
+
+	clientIP, _ := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string)
+	if clientIP == "" {
+		clientIP, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	if clientIP != "" {
+		r.Header.Set("Fly-Client-IP", clientIP)
+	} else {
+		r.Header.Del("Fly-Client-IP")
+	}
+
+	r.Header.Del("Fly-Forwarded-Port")
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			r.Header.Set("Fly-Forwarded-Port", port)
+		}
+	}
+}
+
+// regionDelay waits out the artificial latency configured for a region,
+// returning early if the request is cancelled
+func (f *FlyReplay) regionDelay(ctx context.Context, region string) error {
+	delay := time.Duration(f.RegionLatency[region])
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// inRegions orders instances by the preference of their region in
+// regions; instances outside every listed region are dropped unless
+// the list contains "any"
+func inRegions(instances []*appInstance, regions []string) []*appInstance {
+	var ordered []*appInstance
+	used := make(map[*appInstance]bool)
+	for _, region := range regions {
+		for _, inst := range instances {
+			if used[inst] || (region != anyRegion && inst.region != region) {
+				continue
+			}
+			used[inst] = true
+			ordered = append(ordered, inst)
+		}
+	}
+	return ordered
+}
@@ -0,0 +1,367 @@
+package flyreplay
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReplayDirective is a parsed fly-replay instruction from the platform
+type ReplayDirective struct {
+	App            string   // target app; empty means the app that answered
+	Instance       string   // replay to exactly this instance
+	PreferInstance string   // try this instance first, fall back to any other
+	Regions        []string // candidate regions, in order of preference
+	Elsewhere      bool     // never replay to the instance that answered
+	State          string   // opaque value handed to the target in fly-replay-src
+
+	// Only available through the JSON replay body
+	Transform *ReplayTransform // changes applied to the replayed request
+	Timeout   time.Duration    // upper bound for the replayed request
+	Fallback  string           // what to do when the target can't be reached
+}
+
+// ReplayFallbackPreferSelf sends the request back to the platform, marked
+// with fly-replay-failed, when the replay target can't serve it
+const ReplayFallbackPreferSelf = "prefer_self"
+
+// replayContentType is the media type of Fly's JSON replay response
+const replayContentType = "application/vnd.fly.replay+json"
+
+// maxReplayBodySize caps how much of a JSON replay body is read
+const maxReplayBodySize = 64 << 10
+
+// ReplayTransform describes changes made to the request before it is replayed
+type ReplayTransform struct {
+	Path          string         `json:"path,omitempty"` // new path, optionally with a query
+	SetHeaders    []ReplayHeader `json:"set_headers,omitempty"`
+	DeleteHeaders []string       `json:"delete_headers,omitempty"`
+}
+
+// ReplayHeader is a single header set by a ReplayTransform
+type ReplayHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// replayJSON is the wire format of an application/vnd.fly.replay+json body
+type replayJSON struct {
+	App            string           `json:"app"`
+	Instance       string           `json:"instance"`
+	PreferInstance string           `json:"prefer_instance"`
+	Region         string           `json:"region"`
+	Elsewhere      bool             `json:"elsewhere"`
+	State          string           `json:"state"`
+	Transform      *ReplayTransform `json:"transform"`
+	Timeout        string           `json:"timeout"`
+	Fallback       string           `json:"fallback"`
+}
+
+// ParseReplayDirective parses a fly-replay header value such as
+// "app=foo;instance=abc;state=xyz" or "region=syd,ams;elsewhere=true".
+func ParseReplayDirective(header string) (*ReplayDirective, error) {
+	d := &ReplayDirective{}
+	seen := make(map[string]bool)
+
+	for _, part := range strings.Split(header, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed fly-replay field %q: expected key=value", part)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate fly-replay field %q", key)
+		}
+		seen[key] = true
+
+		if err := d.setField(key, strings.TrimSpace(value)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := d.validate(); err != nil {
+		return nil, fmt.Errorf("fly-replay %q: %w", header, err)
+	}
+	return d, nil
+}
+
+// parseReplayResponse extracts the replay directive from a response, if
+// any. The body is only read when it is a JSON replay body.
+func parseReplayResponse(header http.Header, body func() ([]byte, error)) (*ReplayDirective, error) {
+	if value := header.Get("fly-replay"); value != "" {
+		return ParseReplayDirective(value)
+	}
+
+	if isReplayBody(header) {
+		data, err := body()
+		if err != nil {
+			return nil, fmt.Errorf("reading replay body: %w", err)
+		}
+		return ParseReplayJSON(data)
+	}
+
+	return nil, nil
+}
+
+// isReplayResponse reports whether a response with these headers carries
+// a replay directive, without looking at the body
+func isReplayResponse(header http.Header) bool {
+	return header.Get("fly-replay") != "" || isReplayBody(header)
+}
+
+// isReplayBody reports whether the body is a JSON replay body
+func isReplayBody(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && mediaType == replayContentType
+}
+
+// ParseReplayJSON parses an application/vnd.fly.replay+json response body
+func ParseReplayJSON(body []byte) (*ReplayDirective, error) {
+	// Unknown fields are ignored, like unknown fly-replay header fields
+	var raw replayJSON
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, fmt.Errorf("decoding replay body: %w", err)
+	}
+
+	d := &ReplayDirective{Transform: raw.Transform}
+	fields := []struct{ key, value string }{
+		{"app", raw.App},
+		{"instance", raw.Instance},
+		{"prefer_instance", raw.PreferInstance},
+		{"region", raw.Region},
+		{"state", raw.State},
+	}
+	for _, field := range fields {
+		if field.value == "" {
+			continue
+		}
+		if err := d.setField(field.key, field.value); err != nil {
+			return nil, err
+		}
+	}
+	d.Elsewhere = raw.Elsewhere
+
+	if raw.Timeout != "" {
+		timeout, err := time.ParseDuration(raw.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q", raw.Timeout)
+		}
+		d.Timeout = timeout
+	}
+
+	switch raw.Fallback {
+	case "", ReplayFallbackPreferSelf:
+		d.Fallback = raw.Fallback
+	default:
+		return nil, fmt.Errorf("unsupported fallback %q", raw.Fallback)
+	}
+
+	if d.Transform != nil {
+		if err := d.Transform.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := d.validate(); err != nil {
+		return nil, fmt.Errorf("replay body: %w", err)
+	}
+	return d, nil
+}
+
+// setField applies one key=value pair of the fly-replay grammar
+func (d *ReplayDirective) setField(key, value string) error {
+	switch key {
+	case "app":
+		if !validReplayToken(value) {
+			return fmt.Errorf("invalid app name %q", value)
+		}
+		d.App = value
+	case "instance":
+		if !validReplayToken(value) {
+			return fmt.Errorf("invalid instance id %q", value)
+		}
+		d.Instance = value
+	case "prefer_instance":
+		if !validReplayToken(value) {
+			return fmt.Errorf("invalid prefer_instance id %q", value)
+		}
+		d.PreferInstance = value
+	case "region":
+		for _, region := range strings.Split(value, ",") {
+			region = strings.ToLower(strings.TrimSpace(region))
+			if !validReplayToken(region) {
+				return fmt.Errorf("invalid region %q", region)
+			}
+			d.Regions = append(d.Regions, region)
+		}
+	case "elsewhere":
+		elsewhere, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid elsewhere value %q", value)
+		}
+		d.Elsewhere = elsewhere
+	case "state":
+		// State is opaque, but it ends up in a header of its own
+		if strings.ContainsAny(value, "\r\n;") {
+			return fmt.Errorf("invalid state value %q", value)
+		}
+		d.State = value
+	default:
+		// Ignore fields we don't know yet, like the real proxy does
+	}
+	return nil
+}
+
+// validate checks the combination of fields once they are all set
+func (d *ReplayDirective) validate() error {
+	if d.Instance != "" && d.PreferInstance != "" {
+		return fmt.Errorf("instance and prefer_instance are mutually exclusive")
+	}
+	if d.App == "" && d.Instance == "" && d.PreferInstance == "" && len(d.Regions) == 0 && !d.Elsewhere {
+		return fmt.Errorf("no replay target")
+	}
+	return nil
+}
+
+// String formats the directive back into fly-replay header form
+func (d *ReplayDirective) String() string {
+	var parts []string
+	if d.App != "" {
+		parts = append(parts, "app="+d.App)
+	}
+	if d.Instance != "" {
+		parts = append(parts, "instance="+d.Instance)
+	}
+	if d.PreferInstance != "" {
+		parts = append(parts, "prefer_instance="+d.PreferInstance)
+	}
+	if len(d.Regions) > 0 {
+		parts = append(parts, "region="+strings.Join(d.Regions, ","))
+	}
+	if d.Elsewhere {
+		parts = append(parts, "elsewhere=true")
+	}
+	if d.State != "" {
+		parts = append(parts, "state="+d.State)
+	}
+	return strings.Join(parts, ";")
+}
+
+// ReplaySource builds the fly-replay-src header value the target receives
+func (d *ReplayDirective) ReplaySource() string {
+	src := fmt.Sprintf("t=%d", time.Now().UnixMicro())
+	if d.State != "" {
+		src += ";state=" + d.State
+	}
+	return src
+}
+
+// validate rejects transforms that can't be applied to a request
+func (t *ReplayTransform) validate() error {
+	if t.Path != "" {
+		if !strings.HasPrefix(t.Path, "/") {
+			return fmt.Errorf("transform path %q must start with /", t.Path)
+		}
+		if _, err := url.ParseRequestURI(t.Path); err != nil {
+			return fmt.Errorf("invalid transform path %q: %w", t.Path, err)
+		}
+	}
+	for _, h := range t.SetHeaders {
+		if h.Name == "" || strings.ContainsAny(h.Name, " :\r\n") || strings.ContainsAny(h.Value, "\r\n") {
+			return fmt.Errorf("invalid transform header %q", h.Name)
+		}
+	}
+	return nil
+}
+
+// Apply rewrites r according to the transform
+func (t *ReplayTransform) Apply(r *http.Request) {
+	if t.Path != "" {
+		// Already validated in ParseReplayJSON
+		u, _ := url.ParseRequestURI(t.Path)
+		r.URL.Path = u.Path
+		r.URL.RawPath = u.RawPath
+		r.URL.RawQuery = u.RawQuery
+		r.RequestURI = t.Path
+	}
+	for _, name := range t.DeleteHeaders {
+		r.Header.Del(name)
+	}
+	for _, h := range t.SetHeaders {
+		r.Header.Set(h.Name, h.Value)
+	}
+}
+
+// replayChain records the hops of one request to detect replay loops. A
+// hop is the app instance that served it, so a request may move on to
+// another instance of the same app, but never back to one it has been to.
+type replayChain struct {
+	hops    []string
+	visited map[string]bool
+}
+
+// newReplayChain starts a chain at origin, which is not a replay target
+func newReplayChain(origin string) *replayChain {
+	return &replayChain{
+		hops:    []string{origin},
+		visited: make(map[string]bool),
+	}
+}
+
+// Visit records a hop served by instance of app
+func (c *replayChain) Visit(app, instance string) {
+	key := hopKey(app, instance)
+	c.hops = append(c.hops, key)
+	c.visited[key] = true
+}
+
+// Visited reports whether instance of app served an earlier hop
+func (c *replayChain) Visited(app, instance string) bool {
+	return c.visited[hopKey(app, instance)]
+}
+
+// hopKey names a hop as app/instance, or just app for an app without named
+// instances
+func hopKey(app, instance string) string {
+	if instance == "" {
+		return app
+	}
+	return app + "/" + instance
+}
+
+// Replays returns how many replays the chain has followed
+func (c *replayChain) Replays() int {
+	return len(c.hops) - 1
+}
+
+// String lists the hops, e.g. "platform -> app-a -> app-b"
+func (c *replayChain) String() string {
+	return strings.Join(c.hops, " -> ")
+}
+
+// validReplayToken reports whether s is a usable app, instance or region name
+func validReplayToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,256 @@
+package flyreplay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseReplayDirective(t *testing.T) {
+	tests := []struct {
+		header string
+		want   ReplayDirective
+	}{
+		{"app=foo", ReplayDirective{App: "foo"}},
+		{" app = foo ; ", ReplayDirective{App: "foo"}},
+		{"APP=foo", ReplayDirective{App: "foo"}},
+		{"app=foo;instance=abc;state=xyz", ReplayDirective{App: "foo", Instance: "abc", State: "xyz"}},
+		{"app=foo;prefer_instance=abc", ReplayDirective{App: "foo", PreferInstance: "abc"}},
+		{"instance=abc", ReplayDirective{Instance: "abc"}},
+		{"region=SYD, ams", ReplayDirective{Regions: []string{"syd", "ams"}}},
+		{"region=syd,ams;elsewhere=true", ReplayDirective{Regions: []string{"syd", "ams"}, Elsewhere: true}},
+		{"elsewhere=1", ReplayDirective{Elsewhere: true}},
+		{"app=foo;state=a=b,c", ReplayDirective{App: "foo", State: "a=b,c"}},
+		{"app=foo;future=whatever", ReplayDirective{App: "foo"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseReplayDirective(tt.header)
+		if err != nil {
+			t.Errorf("ParseReplayDirective(%q) error = %v", tt.header, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("ParseReplayDirective(%q) = %+v, want %+v", tt.header, *got, tt.want)
+		}
+	}
+}
+
+func TestParseReplayDirectiveRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"empty", ""},
+		{"no target", "state=xyz"},
+		{"only unknown fields", "future=whatever"},
+		{"missing value", "app"},
+		{"duplicate field", "app=foo;app=bar"},
+		{"duplicate field in another case", "app=foo;App=bar"},
+		{"empty app", "app="},
+		{"invalid app", "app=foo/bar"},
+		{"invalid instance", "app=foo;instance=a b"},
+		{"invalid region", "region=syd,"},
+		{"invalid elsewhere", "elsewhere=maybe"},
+		{"instance and prefer_instance", "app=foo;instance=a;prefer_instance=b"},
+		{"state with a newline", "app=foo;state=a\r\nX-Injected: 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if d, err := ParseReplayDirective(tt.header); err == nil {
+				t.Errorf("ParseReplayDirective(%q) = %+v, want an error", tt.header, *d)
+			}
+		})
+	}
+}
+
+func TestParseReplayJSON(t *testing.T) {
+	body := `{
+		"app": "foo",
+		"prefer_instance": "abc",
+		"region": "syd,ams",
+		"elsewhere": true,
+		"state": "a;b",
+		"transform": {
+			"path": "/v2/items?page=2",
+			"set_headers": [{"name": "X-Tenant", "value": "t1"}],
+			"delete_headers": ["Cookie"]
+		},
+		"timeout": "2s",
+		"fallback": "prefer_self",
+		"future": {"nested": true}
+	}`
+	got, err := ParseReplayJSON([]byte(body))
+	if err == nil {
+		t.Fatalf("ParseReplayJSON() accepted a state with a semicolon: %+v", *got)
+	}
+
+	body = strings.Replace(body, `"a;b"`, `"xyz"`, 1)
+	got, err = ParseReplayJSON([]byte(body))
+	if err != nil {
+		t.Fatalf("ParseReplayJSON() error = %v", err)
+	}
+	want := ReplayDirective{
+		App:            "foo",
+		PreferInstance: "abc",
+		Regions:        []string{"syd", "ams"},
+		Elsewhere:      true,
+		State:          "xyz",
+		Transform: &ReplayTransform{
+			Path:          "/v2/items?page=2",
+			SetHeaders:    []ReplayHeader{{Name: "X-Tenant", Value: "t1"}},
+			DeleteHeaders: []string{"Cookie"},
+		},
+		Timeout:  2 * time.Second,
+		Fallback: ReplayFallbackPreferSelf,
+	}
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("ParseReplayJSON() = %+v, want %+v", *got, want)
+	}
+}
+
+func TestParseReplayJSONRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"not JSON", `app=foo`},
+		{"wrong type", `{"app": 1}`},
+		{"no target", `{"state": "xyz"}`},
+		{"invalid app", `{"app": "foo bar"}`},
+		{"instance and prefer_instance", `{"app": "foo", "instance": "a", "prefer_instance": "b"}`},
+		{"invalid timeout", `{"app": "foo", "timeout": "soon"}`},
+		{"negative timeout", `{"app": "foo", "timeout": "-1s"}`},
+		{"unknown fallback", `{"app": "foo", "fallback": "retry"}`},
+		{"relative transform path", `{"app": "foo", "transform": {"path": "v2/items"}}`},
+		{"invalid transform path", `{"app": "foo", "transform": {"path": "/%zz"}}`},
+		{"empty header name", `{"app": "foo", "transform": {"set_headers": [{"name": "", "value": "x"}]}}`},
+		{"header name with a colon", `{"app": "foo", "transform": {"set_headers": [{"name": "X-A:", "value": "x"}]}}`},
+		{"header value with a newline", `{"app": "foo", "transform": {"set_headers": [{"name": "X-A", "value": "x\r\nX-B: y"}]}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if d, err := ParseReplayJSON([]byte(tt.body)); err == nil {
+				t.Errorf("ParseReplayJSON(%s) = %+v, want an error", tt.body, *d)
+			}
+		})
+	}
+}
+
+func TestParseReplayResponse(t *testing.T) {
+	bodyRead := false
+	body := func() ([]byte, error) {
+		bodyRead = true
+		return []byte(`{"app": "from-body"}`), nil
+	}
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		want     string // App of the directive, empty for none
+		readBody bool
+	}{
+		{"no directive", http.Header{"Content-Type": {"text/html"}}, "", false},
+		{"header", http.Header{"Fly-Replay": {"app=from-header"}}, "from-header", false},
+		{"header wins over body", http.Header{
+			"Fly-Replay":   {"app=from-header"},
+			"Content-Type": {replayContentType},
+		}, "from-header", false},
+		{"body", http.Header{"Content-Type": {replayContentType + "; charset=utf-8"}}, "from-body", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bodyRead = false
+			d, err := parseReplayResponse(tt.header, body)
+			if err != nil {
+				t.Fatalf("parseReplayResponse() error = %v", err)
+			}
+			var got string
+			if d != nil {
+				got = d.App
+			}
+			if got != tt.want {
+				t.Errorf("app = %q, want %q", got, tt.want)
+			}
+			if bodyRead != tt.readBody {
+				t.Errorf("read body = %v, want %v", bodyRead, tt.readBody)
+			}
+			if want := tt.want != ""; isReplayResponse(tt.header) != want {
+				t.Errorf("isReplayResponse() = %v, want %v", !want, want)
+			}
+		})
+	}
+}
+
+func TestReplayDirectiveString(t *testing.T) {
+	for _, header := range []string{
+		"app=foo",
+		"app=foo;instance=abc;state=xyz",
+		"app=foo;prefer_instance=abc;region=syd,ams;elsewhere=true",
+	} {
+		d, err := ParseReplayDirective(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.String(); got != header {
+			t.Errorf("String() = %q, want %q", got, header)
+		}
+	}
+}
+
+func TestReplayTransformApply(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v1/items?page=1", nil)
+	r.Header.Set("Cookie", "sid=1")
+	r.Header.Set("X-Tenant", "old")
+
+	transform := &ReplayTransform{
+		Path:          "/v2/a%2Fb?page=2",
+		SetHeaders:    []ReplayHeader{{Name: "X-Tenant", Value: "t1"}},
+		DeleteHeaders: []string{"cookie"},
+	}
+	if err := transform.validate(); err != nil {
+		t.Fatal(err)
+	}
+	transform.Apply(r)
+
+	if r.URL.Path != "/v2/a/b" || r.URL.RawPath != "/v2/a%2Fb" || r.URL.RawQuery != "page=2" {
+		t.Errorf("URL = %q %q %q", r.URL.Path, r.URL.RawPath, r.URL.RawQuery)
+	}
+	if r.RequestURI != transform.Path {
+		t.Errorf("RequestURI = %q, want %q", r.RequestURI, transform.Path)
+	}
+	if r.Header.Get("Cookie") != "" {
+		t.Errorf("Cookie wasn't deleted")
+	}
+	if got := r.Header.Values("X-Tenant"); len(got) != 1 || got[0] != "t1" {
+		t.Errorf("X-Tenant = %q, want [t1]", got)
+	}
+}
+
+func TestReplayChain(t *testing.T) {
+	chain := newReplayChain("platform")
+	chain.Visit("a", "1")
+	chain.Visit("b", "")
+	for _, hop := range []struct {
+		app, instance string
+		visited       bool
+	}{
+		{"a", "1", true},
+		{"a", "2", false},
+		{"a", "", false},
+		{"b", "", true},
+		{"c", "", false},
+	} {
+		if got := chain.Visited(hop.app, hop.instance); got != hop.visited {
+			t.Errorf("Visited(%q, %q) = %v, want %v", hop.app, hop.instance, got, hop.visited)
+		}
+	}
+	if chain.Replays() != 2 {
+		t.Errorf("Replays() = %d, want 2", chain.Replays())
+	}
+	if want := "platform -> a/1 -> b"; chain.String() != want {
+		t.Errorf("String() = %q, want %q", chain.String(), want)
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -115,7 +117,6 @@ func printResponse(resp *Response, tc TestCase) {
 	// Print relevant headers
 	fmt.Printf("%sResponse Headers:%s\n", green, reset)
 	relevantHeaders := []string{
-		"X-Cached-App", "X-Cache-Action", "X-Cache-Pattern", "X-Cache-Allow-Bypass",
 		"X-App-Name", "X-User-ID", "X-Trace-ID", "X-Timestamp",
 	}
 	
@@ -205,6 +206,69 @@ func verifyTest(resp *Response, tc TestCase) bool {
 	return passed
 }
 
+// UpgradeTestCase tunnels a line through an upgraded connection
+type UpgradeTestCase struct {
+	Name        string
+	Path        string
+	ExpectApp   string
+	ExpectCache string
+}
+
+// runUpgradeTest upgrades a raw connection to the test apps' echo protocol
+// and checks that a line makes the round trip through the replayed tunnel
+func runUpgradeTest(tc UpgradeTestCase) bool {
+	fmt.Printf("%sRequest:%s GET %s (Upgrade: fly-replay-echo)\n", cyan, reset, proxyURL+tc.Path)
+
+	conn, err := net.DialTimeout("tcp", strings.TrimPrefix(proxyURL, "http://"), 5*time.Second)
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", red, err, reset)
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: localhost:3000\r\nUpgrade: fly-replay-echo\r\nConnection: Upgrade\r\n\r\n", tc.Path)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", red, err, reset)
+		return false
+	}
+
+	fmt.Printf("\n%sResponse Status:%s %d\n", green, reset, resp.StatusCode)
+	fmt.Printf("\n%sVerification:%s\n", blue, reset)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		fmt.Printf("  %s✗ Expected 101 Switching Protocols%s\n", red, reset)
+		return false
+	}
+
+	passed := true
+	if app := resp.Header.Get("X-App-Name"); app == tc.ExpectApp {
+		fmt.Printf("  ✓ Upgraded by %s\n", app)
+	} else {
+		fmt.Printf("  %s✗ Upgraded by %s, expected %s%s\n", red, app, tc.ExpectApp, reset)
+		passed = false
+	}
+	if status := resp.Header.Get("fly-replay-cache-status"); status == tc.ExpectCache {
+		fmt.Printf("  ✓ Cache behavior correct: %s\n", status)
+	} else {
+		fmt.Printf("  %s✗ Cache behavior incorrect: expected %s, got %s%s\n", red, tc.ExpectCache, status, reset)
+		passed = false
+	}
+
+	fmt.Fprintf(conn, "ping\n")
+	line, err := reader.ReadString('\n')
+	if expected := tc.ExpectApp + ": ping\n"; err == nil && line == expected {
+		fmt.Printf("  ✓ Tunnel echoed: %s", line)
+	} else {
+		fmt.Printf("  %s✗ Tunnel echo incorrect: %q (%v)%s\n", red, line, err, reset)
+		passed = false
+	}
+
+	return passed
+}
+
 func clearCache() {
 	// Make a request to an invalid path to trigger a platform response
 	// This helps ensure we start with a clean state
@@ -395,6 +459,34 @@ func runTests() {
 		time.Sleep(500 * time.Millisecond)
 	}
 	
+	upgradeTestCases := []UpgradeTestCase{
+		{
+			Name:        "Upgrade - First request to user789 (cache miss)",
+			Path:        "/fr-FR/user789/ws",
+			ExpectApp:   "user789-app",
+			ExpectCache: "miss",
+		},
+		{
+			Name:        "Upgrade - Second request to user789 (cache hit)",
+			Path:        "/fr-FR/user789/ws",
+			ExpectApp:   "user789-app",
+			ExpectCache: "hit",
+		},
+	}
+	totalTests += len(upgradeTestCases)
+
+	for i, tc := range upgradeTestCases {
+		printTestHeader(fmt.Sprintf("[%d/%d] %s", len(testCases)+i+1, totalTests, tc.Name))
+		if runUpgradeTest(tc) {
+			passedTests++
+			fmt.Printf("%s✓ Test passed%s\n", green, reset)
+		} else {
+			fmt.Printf("%s✗ Test failed%s\n", red, reset)
+		}
+
+		time.Sleep(500 * time.Millisecond)
+	}
+	
 	// Print summary
 	fmt.Printf("\n%s━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━%s\n", blue, reset)
 	fmt.Printf("%s=== Test Summary ===%s\n", blue, reset)
@@ -415,6 +507,7 @@ func runTests() {
 	fmt.Println("• Cache bypass functionality with fly-replay-cache-control: skip")
 	fmt.Println("• Cache status header (fly-replay-cache-status) indicates hit/miss/bypass")
 	fmt.Println("• Special characters in headers are handled properly")
+	fmt.Println("• Upgrade requests are replayed and tunneled to the app, from cache or platform")
 }
 
 func main() {
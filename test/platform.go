@@ -50,6 +50,10 @@ func main() {
 			default:
 				// Unknown user
 				log.Printf("[PLATFORM] [TraceID: %s] Unknown user: %s", traceID, userID)
+
+				// Let Caddy answer for this user itself for a minute
+				w.Header().Set("fly-replay-cache", fmt.Sprintf("/%s/%s/*", locale, userID))
+				w.Header().Set("fly-replay-cache-ttl-secs", "60")
 				http.Error(w, "User not found", http.StatusNotFound)
 				return
 			}
@@ -20,6 +20,35 @@ func generateTraceID() string {
 	return hex.EncodeToString(bytes)
 }
 
+// echoProtocol is the Upgrade protocol the integration tests tunnel through Caddy
+const echoProtocol = "fly-replay-echo"
+
+// serveEcho switches the connection to echoProtocol and echoes every line
+// back, prefixed with the app name
+func serveEcho(w http.ResponseWriter, r *http.Request, appName, traceID string) {
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Printf("[%s] [TraceID: %s] Upgrade failed: %v", appName, traceID, err)
+		http.Error(w, "Upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	log.Printf("[%s] [TraceID: %s] Upgraded to %s (cache status: %s)", appName, traceID, echoProtocol, r.Header.Get("fly-replay-cache-status"))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: %s\r\nConnection: Upgrade\r\nX-App-Name: %s\r\nfly-replay-cache-status: %s\r\n\r\n",
+		echoProtocol, appName, r.Header.Get("fly-replay-cache-status"))
+	rw.Flush()
+
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(rw, "%s: %s", appName, line)
+		rw.Flush()
+	}
+}
+
 // Mock user app server with enhanced header and body handling
 func main() {
 	var (
@@ -43,6 +72,12 @@ func main() {
 		
 		log.Printf("[%s] [TraceID: %s] Received request: %s %s", appName, traceID, r.Method, r.URL.Path)
 
+		// Upgrade requests switch to a line echo protocol
+		if strings.EqualFold(r.Header.Get("Upgrade"), echoProtocol) {
+			serveEcho(w, r, appName, traceID)
+			return
+		}
+
 		// Check and log cache status
 		if cacheStatus := r.Header.Get("fly-replay-cache-status"); cacheStatus != "" {
 			log.Printf("[%s] [TraceID: %s] Cache Status: %s", appName, traceID, cacheStatus)
@@ -0,0 +1,52 @@
+package flyreplay
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the module's spans
+const tracerName = "github.com/kahgeh/caddy-fly-replay"
+
+// Span attributes
+const (
+	attrApp          = attribute.Key("fly_replay.app")
+	attrInstance     = attribute.Key("fly_replay.instance")
+	attrCacheStatus  = attribute.Key("fly_replay.cache_status")
+	attrCachePattern = attribute.Key("fly_replay.cache_pattern")
+	attrDirective    = attribute.Key("fly_replay.directive")
+	attrHops         = attribute.Key("fly_replay.hops")
+)
+
+// startSpan starts a child of the span in r's context and returns r with
+// the new span attached. The span comes from the same provider as the
+// parent, i.e. Caddy's tracing handler; without one it is a no-op.
+func startSpan(r *http.Request, name string, attrs ...attribute.KeyValue) (*http.Request, trace.Span) {
+	ctx := r.Context()
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	ctx, span := tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	return r.WithContext(ctx), span
+}
+
+// propagateTrace writes the span in r's context to r's traceparent and
+// tracestate headers, so the upstream's spans join the trace. Headers sent
+// by the client are left alone when there is no span.
+func propagateTrace(r *http.Request) {
+	if !trace.SpanContextFromContext(r.Context()).IsValid() {
+		return
+	}
+	propagation.TraceContext{}.Inject(r.Context(), propagation.HeaderCarrier(r.Header))
+}
+
+// endSpan marks the span as failed when err is set, then ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,254 @@
+package flyreplay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// Transport defaults, matching Caddy's reverse_proxy http transport
+const (
+	defaultDialTimeout         = 3 * time.Second
+	defaultKeepAlive           = 30 * time.Second
+	defaultIdleConnTimeout     = 2 * time.Minute
+	defaultMaxIdleConnsPerHost = 32
+)
+
+// forwardState carries the outcome of one proxied request out of the
+// shared ReverseProxy callbacks
+type forwardState struct {
+	replayed  *ReplayDirective // replay issued by the app, if any
+	replayErr error            // the app answered with a replay that doesn't parse
+	err       error            // transport failure
+}
+
+// forwardStateKey is the context key for *forwardState
+type forwardStateKey struct{}
+
+// provision builds the app's shared transport and reverse proxy, or loads
+// its reverse_proxy handler when one is configured
+func (a *AppConfig) provision(ctx caddy.Context, localRegion string) error {
+	a.Region = strings.ToLower(a.Region)
+	if a.Region == "" {
+		a.Region = localRegion
+	}
+
+	if a.ReverseProxyRaw != nil {
+		mod, err := ctx.LoadModule(a, "ReverseProxyRaw")
+		if err != nil {
+			return fmt.Errorf("loading reverse_proxy handler: %w", err)
+		}
+		rp, ok := mod.(*reverseproxy.Handler)
+		if !ok {
+			return fmt.Errorf("handler must be reverse_proxy, got %T", mod)
+		}
+		a.reverseProxy = rp
+		return nil
+	}
+
+	if a.Domain == "" && len(a.Instances) == 0 {
+		return fmt.Errorf("either domain, instances or reverse_proxy is required")
+	}
+	if a.Domain != "" && len(a.Instances) > 0 {
+		return fmt.Errorf("domain and instances are mutually exclusive")
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   durationOr(a.DialTimeout, defaultDialTimeout),
+		KeepAlive: durationOr(a.KeepAlive, defaultKeepAlive),
+	}
+
+	// One transport per app, shared by all of its instances
+	a.transport = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          a.MaxIdleConns,
+		MaxIdleConnsPerHost:   a.MaxIdleConnsPerHost,
+		IdleConnTimeout:       durationOr(a.IdleConnTimeout, defaultIdleConnTimeout),
+		ResponseHeaderTimeout: time.Duration(a.ResponseHeaderTimeout),
+		DisableKeepAlives:     a.KeepAlive < 0,
+		ForceAttemptHTTP2:     true,
+	}
+	if a.transport.MaxIdleConnsPerHost == 0 {
+		a.transport.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+
+	// A plain domain is an app with a single, unnamed instance
+	if a.Domain != "" {
+		inst, err := a.newInstance("", InstanceConfig{Address: a.Domain})
+		if err != nil {
+			return err
+		}
+		a.instances = []*appInstance{inst}
+	}
+
+	ids := make([]string, 0, len(a.Instances))
+	for id := range a.Instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if !validReplayToken(id) {
+			return fmt.Errorf("invalid instance id %q", id)
+		}
+		inst, err := a.newInstance(id, a.Instances[id])
+		if err != nil {
+			return fmt.Errorf("instance %s: %w", id, err)
+		}
+		a.instances = append(a.instances, inst)
+	}
+
+	a.rotation = new(atomic.Uint64)
+	return nil
+}
+
+// newInstance builds the reverse proxy for one instance of the app
+func (a *AppConfig) newInstance(id string, cfg InstanceConfig) (*appInstance, error) {
+	address := cfg.Address
+	if address == "" {
+		return nil, fmt.Errorf("address is required")
+	}
+	if !strings.HasPrefix(address, "http://") && !strings.HasPrefix(address, "https://") {
+		address = "http://" + address
+	}
+
+	target, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target domain: %w", err)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = a.transport
+
+	// Intercept replays issued by the app before anything reaches the client
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		directive, err := parseReplayResponse(resp.Header, func() ([]byte, error) {
+			return io.ReadAll(io.LimitReader(resp.Body, maxReplayBodySize))
+		})
+		if err != nil {
+			forwardStateFrom(resp.Request.Context()).replayErr = fmt.Errorf("app %s: %w: %w", target.Host, errInvalidAppReplay, err)
+			return errAppReplayed
+		}
+		if directive != nil {
+			forwardStateFrom(resp.Request.Context()).replayed = directive
+			return errAppReplayed
+		}
+		return nil
+	}
+
+	// Hand transport failures to Caddy's error handling instead of
+	// letting the proxy write its own 502
+	proxy.ErrorHandler = func(_ http.ResponseWriter, r *http.Request, err error) {
+		forwardStateFrom(r.Context()).err = err
+	}
+
+	region := strings.ToLower(cfg.Region)
+	if region == "" {
+		region = a.Region
+	}
+
+	return &appInstance{
+		id:     id,
+		region: region,
+		target: target,
+		proxy:  proxy,
+	}, nil
+}
+
+// candidates lists the instances that may serve a replay, in the order they
+// should be tried. The instance named by exclude is never returned; an
+// empty exclude excludes nothing, since a domain app's single instance has
+// no name.
+func (a *AppConfig) candidates(d *ReplayDirective, exclude string) ([]*appInstance, error) {
+	if d.Instance != "" {
+		inst := a.instance(d.Instance)
+		if inst == nil || inst.id == exclude {
+			return nil, fmt.Errorf("app %s has no instance %q", d.App, d.Instance)
+		}
+		if len(d.Regions) > 0 && len(inRegions([]*appInstance{inst}, d.Regions)) == 0 {
+			return nil, fmt.Errorf("instance %q of app %s is not in region %s", d.Instance, d.App, strings.Join(d.Regions, ","))
+		}
+		return []*appInstance{inst}, nil
+	}
+
+	// Spread requests across instances, starting at the next one in turn
+	var ordered []*appInstance
+	start := int(a.rotation.Add(1) % uint64(len(a.instances)))
+	for i := range a.instances {
+		inst := a.instances[(start+i)%len(a.instances)]
+		if exclude != "" && inst.id == exclude {
+			continue
+		}
+		ordered = append(ordered, inst)
+	}
+
+	// Keep only instances in the requested regions, nearest preference first
+	if len(d.Regions) > 0 {
+		ordered = inRegions(ordered, d.Regions)
+		if len(ordered) == 0 {
+			return nil, fmt.Errorf("app %s has no instance in region %s", d.App, strings.Join(d.Regions, ","))
+		}
+	}
+
+	// A preferred instance goes first, the rest stay as fallbacks
+	if d.PreferInstance != "" {
+		for i, inst := range ordered {
+			if inst.id == d.PreferInstance {
+				copy(ordered[1:i+1], ordered[:i])
+				ordered[0] = inst
+				break
+			}
+		}
+	}
+
+	if len(ordered) == 0 {
+		return nil, fmt.Errorf("app %s has no other instance to replay to", d.App)
+	}
+	return ordered, nil
+}
+
+// instance returns the instance with the given id, or nil
+func (a *AppConfig) instance(id string) *appInstance {
+	for _, inst := range a.instances {
+		if inst.id == id {
+			return inst
+		}
+	}
+	return nil
+}
+
+// cleanup releases the app's pooled connections
+func (a *AppConfig) cleanup() {
+	if a.transport != nil {
+		a.transport.CloseIdleConnections()
+	}
+}
+
+// forwardStateFrom returns the state attached by forwardToApp. Requests
+// that didn't come through forwardToApp get a throwaway state.
+func forwardStateFrom(ctx context.Context) *forwardState {
+	if state, ok := ctx.Value(forwardStateKey{}).(*forwardState); ok {
+		return state
+	}
+	return new(forwardState)
+}
+
+// durationOr returns d, or def when d is unset. Negative values mean
+// "disabled" and are returned as is.
+func durationOr(d caddy.Duration, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return time.Duration(d)
+}
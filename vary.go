@@ -0,0 +1,110 @@
+package flyreplay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Fields of a fly-replay-cache-vary header that aren't request headers
+const (
+	varyMethod       = ":method" // the request method
+	varyCookiePrefix = "cookie:" // cookie:<name> is the named cookie
+)
+
+// maxVaryFields limits how many request values an entry can vary on
+const maxVaryFields = 8
+
+// parseVary parses a fly-replay-cache-vary header, a comma-separated list
+// of request header names like HTTP's Vary, where cookie:<name> names a
+// cookie and :method the request method. The fields are normalized and
+// sorted, so the same set always yields the same variants.
+func parseVary(value string) ([]string, error) {
+	var vary []string
+	for field := range strings.SplitSeq(value, ",") {
+		field = strings.TrimSpace(field)
+		switch {
+		case field == "":
+			continue
+		case strings.EqualFold(field, varyMethod):
+			field = varyMethod
+		case len(field) > len(varyCookiePrefix) && strings.EqualFold(field[:len(varyCookiePrefix)], varyCookiePrefix):
+			// Cookie names are case-sensitive
+			name := strings.TrimSpace(field[len(varyCookiePrefix):])
+			if !validToken(name) {
+				return nil, fmt.Errorf("invalid cookie name in %q", field)
+			}
+			field = varyCookiePrefix + name
+		case validToken(field):
+			field = http.CanonicalHeaderKey(field)
+		default:
+			return nil, fmt.Errorf("invalid header name %q", field)
+		}
+		if !slices.Contains(vary, field) {
+			vary = append(vary, field)
+		}
+	}
+	if len(vary) > maxVaryFields {
+		return nil, fmt.Errorf("more than %d fields", maxVaryFields)
+	}
+	slices.Sort(vary)
+	return vary, nil
+}
+
+// variantKey identifies the variant of r for the fields in vary. It is a
+// hash of the values, so credentials such as Authorization are neither
+// kept in memory nor written to the snapshot. A nil r has every value
+// missing.
+func variantKey(vary []string, r *http.Request) string {
+	h := sha256.New()
+	for _, field := range vary {
+		value, present := varyValue(field, r)
+		h.Write([]byte(field))
+		if present {
+			h.Write([]byte{1})
+			h.Write([]byte(value))
+		}
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// varyValue returns the value of one vary field in r, and whether r has it
+func varyValue(field string, r *http.Request) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	switch {
+	case field == varyMethod:
+		return r.Method, true
+	case strings.HasPrefix(field, varyCookiePrefix):
+		cookie, err := r.Cookie(field[len(varyCookiePrefix):])
+		if err != nil {
+			return "", false
+		}
+		return cookie.Value, true
+	}
+	values := r.Header.Values(field)
+	return strings.Join(values, ", "), len(values) > 0
+}
+
+// validToken reports whether s is an HTTP token, as header and cookie
+// names are
+func validToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
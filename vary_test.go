@@ -0,0 +1,111 @@
+package flyreplay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestParseVary(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"", nil},
+		{" , ", nil},
+		{"accept-language", []string{"Accept-Language"}},
+		{"X-Tenant, accept-language", []string{"Accept-Language", "X-Tenant"}},
+		{"x-tenant, X-Tenant", []string{"X-Tenant"}},
+		{":METHOD", []string{":method"}},
+		{"Cookie:session", []string{"cookie:session"}},
+		{"cookie: Session, cookie:session", []string{"cookie:Session", "cookie:session"}},
+		{"authorization, :method, cookie:sid", []string{":method", "Authorization", "cookie:sid"}},
+	}
+	for _, tt := range tests {
+		got, err := parseVary(tt.value)
+		if err != nil {
+			t.Errorf("parseVary(%q) error = %v", tt.value, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseVary(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseVaryRejects(t *testing.T) {
+	tests := []string{
+		"x tenant",
+		"x-tenant, a/b",
+		"cookie:",
+		"cookie:a;b",
+		":path",
+		"a, b, c, d, e, f, g, h, i",
+	}
+	for _, value := range tests {
+		if _, err := parseVary(value); err == nil {
+			t.Errorf("parseVary(%q) accepted an invalid value", value)
+		}
+	}
+}
+
+func TestVariantKey(t *testing.T) {
+	vary := []string{":method", "Accept-Language", "cookie:sid"}
+
+	request := func(method, language, sid string) *http.Request {
+		r := httptest.NewRequest(method, "/", nil)
+		if language != "" {
+			r.Header.Set("Accept-Language", language)
+		}
+		if sid != "" {
+			r.AddCookie(&http.Cookie{Name: "sid", Value: sid})
+		}
+		return r
+	}
+
+	base := variantKey(vary, request("GET", "en", "1"))
+	if len(base) != 32 {
+		t.Errorf("variantKey() = %q, want 32 hex digits", base)
+	}
+	if got := variantKey(vary, request("GET", "en", "1")); got != base {
+		t.Errorf("same values gave %q and %q", base, got)
+	}
+
+	// Other cookies and headers don't matter
+	r := request("GET", "en", "1")
+	r.Header.Set("X-Other", "x")
+	r.AddCookie(&http.Cookie{Name: "other", Value: "x"})
+	if got := variantKey(vary, r); got != base {
+		t.Errorf("values outside vary changed the key")
+	}
+
+	for name, r := range map[string]*http.Request{
+		"method":         request("POST", "en", "1"),
+		"header":         request("GET", "fr", "1"),
+		"cookie":         request("GET", "en", "2"),
+		"missing header": request("GET", "", "1"),
+		"missing cookie": request("GET", "en", ""),
+	} {
+		if got := variantKey(vary, r); got == base {
+			t.Errorf("a different %s gave the same key", name)
+		}
+	}
+
+	// A missing value differs from an empty one, and values can't run into
+	// the next field
+	header := []string{"A", "B"}
+	empty := httptest.NewRequest("GET", "/", nil)
+	empty.Header.Set("A", "")
+	if variantKey(header, empty) == variantKey(header, nil) {
+		t.Errorf("an empty header gave the same key as a missing one")
+	}
+	shifted := httptest.NewRequest("GET", "/", nil)
+	shifted.Header.Set("A", "xB")
+	joined := httptest.NewRequest("GET", "/", nil)
+	joined.Header.Set("A", "x")
+	joined.Header.Set("B", "")
+	if variantKey(header, shifted) == variantKey(header, joined) {
+		t.Errorf("a value running into the next field gave the same key")
+	}
+}